@@ -1,5 +1,12 @@
 package server
 
+import "net"
+
 type Auth interface {
 	CheckPasswd(string, string) (bool, error)
 }
+
+// Auth which is also given the address of the client, if implemented
+type AddrAuth interface {
+	CheckPasswdFrom(string, string, net.Addr) (bool, error)
+}
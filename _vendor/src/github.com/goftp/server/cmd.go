@@ -112,7 +112,12 @@ func (cmd commandAppe) RequireAuth() bool {
 
 func (cmd commandAppe) Execute(conn *Conn, param string) {
 	conn.appendData = true
-	conn.writeMessage(202, "Obsolete")
+	if param == "" {
+		conn.writeMessage(202, "Obsolete")
+		return
+	}
+	// APPE <path>: store with appending
+	commandStor{}.Execute(conn, param)
 }
 
 type commandOpts struct{}
@@ -175,10 +180,11 @@ func init() {
 }
 
 func (cmd commandFeat) Execute(conn *Conn, param string) {
+	cmds := featCmds
 	if conn.tlsConfig != nil {
-		featCmds += " AUTH TLS\n PBSZ\n PROT\n"
+		cmds += " AUTH TLS\n PBSZ\n PROT\n"
 	}
-	conn.writeMessage(211, fmt.Sprintf(feats, featCmds))
+	conn.writeMessage(211, fmt.Sprintf(feats, cmds))
 }
 
 // cmdCdup responds to the CDUP FTP command.
@@ -283,6 +289,10 @@ func (cmd commandEprt) Execute(conn *Conn, param string) {
 		conn.writeMessage(522, "Network protocol not supported, use (1,2)")
 		return
 	}
+	if conn.protected || conn.server.ForceTLS {
+		conn.writeMessage(534, "Active mode data connections cannot be encrypted, use EPSV")
+		return
+	}
 	socket, err := newActiveSocket(host, port, conn.logger)
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
@@ -310,6 +320,10 @@ func (cmd commandEpsv) RequireAuth() bool {
 }
 
 func (cmd commandEpsv) Execute(conn *Conn, param string) {
+	if conn.server.ForceTLS && !conn.protected {
+		conn.writeMessage(534, "Data connections must be encrypted, use PROT P first")
+		return
+	}
 	addr := conn.passiveListenIP()
 	lastIdx := strings.LastIndex(addr, ":")
 	if lastIdx <= 0 {
@@ -317,7 +331,7 @@ func (cmd commandEpsv) Execute(conn *Conn, param string) {
 		return
 	}
 
-	socket, err := newPassiveSocket(addr[:lastIdx], conn.PassivePort(), conn.logger, conn.tlsConfig)
+	socket, err := newPassiveSocket(addr[:lastIdx], conn.PassivePort(), conn.logger, conn.dataTLSConfig())
 	if err != nil {
 		log.Error(err)
 		conn.writeMessage(425, "Data connection failed")
@@ -560,7 +574,13 @@ func (cmd commandPass) RequireAuth() bool {
 }
 
 func (cmd commandPass) Execute(conn *Conn, param string) {
-	ok, err := conn.server.Auth.CheckPasswd(conn.reqUser, param)
+	var ok bool
+	var err error
+	if auth, isAddrAuth := conn.server.Auth.(AddrAuth); isAddrAuth {
+		ok, err = auth.CheckPasswdFrom(conn.reqUser, param, conn.conn.RemoteAddr())
+	} else {
+		ok, err = conn.server.Auth.CheckPasswd(conn.reqUser, param)
+	}
 	if err != nil {
 		conn.writeMessage(550, "Checking password error")
 		return
@@ -594,8 +614,12 @@ func (cmd commandPasv) RequireAuth() bool {
 }
 
 func (cmd commandPasv) Execute(conn *Conn, param string) {
+	if conn.server.ForceTLS && !conn.protected {
+		conn.writeMessage(534, "Data connections must be encrypted, use PROT P first")
+		return
+	}
 	listenIP := conn.passiveListenIP()
-	socket, err := newPassiveSocket(listenIP, conn.PassivePort(), conn.logger, conn.tlsConfig)
+	socket, err := newPassiveSocket(listenIP, conn.PassivePort(), conn.logger, conn.dataTLSConfig())
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
 		return
@@ -633,6 +657,10 @@ func (cmd commandPort) Execute(conn *Conn, param string) {
 	portTwo, _ := strconv.Atoi(nums[5])
 	port := (portOne * 256) + portTwo
 	host := nums[0] + "." + nums[1] + "." + nums[2] + "." + nums[3]
+	if conn.protected || conn.server.ForceTLS {
+		conn.writeMessage(534, "Active mode data connections cannot be encrypted, use PASV")
+		return
+	}
 	socket, err := newActiveSocket(host, port, conn.logger)
 	if err != nil {
 		conn.writeMessage(425, "Data connection failed")
@@ -851,8 +879,7 @@ func (cmd commandAuth) RequireAuth() bool {
 }
 
 func (cmd commandAuth) Execute(conn *Conn, param string) {
-	log.Println(param, conn)
-	if param == "TLS" && conn.tlsConfig != nil {
+	if param == "TLS" && conn.tlsConfig != nil && !conn.tls {
 		conn.writeMessage(234, "AUTH command OK")
 		err := conn.upgradeToTLS()
 		if err != nil {
@@ -955,6 +982,10 @@ func (cmd commandProt) RequireAuth() bool {
 
 func (cmd commandProt) Execute(conn *Conn, param string) {
 	if conn.tls && param == "P" {
+		conn.protected = true
+		conn.writeMessage(200, "OK")
+	} else if conn.tls && param == "C" && !conn.server.ForceTLS {
+		conn.protected = false
 		conn.writeMessage(200, "OK")
 	} else if conn.tls {
 		conn.writeMessage(536, "Only P level is supported")
@@ -1141,6 +1172,10 @@ func (cmd commandUser) RequireAuth() bool {
 }
 
 func (cmd commandUser) Execute(conn *Conn, param string) {
+	if conn.server.ForceTLS && !conn.tls {
+		conn.writeMessage(530, "TLS required, use AUTH TLS first")
+		return
+	}
 	conn.reqUser = param
 	conn.writeMessage(331, "User name ok, password required")
 }
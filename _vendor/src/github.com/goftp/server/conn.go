@@ -40,6 +40,8 @@ type Conn struct {
 	appendData    bool
 	closed        bool
 	tls           bool
+	// data connections are encrypted (PROT P)
+	protected bool
 }
 
 func (conn *Conn) LoginUser() string {
@@ -144,6 +146,14 @@ func (conn *Conn) upgradeToTLS() error {
 	return err
 }
 
+// TLS configuration for new data connections; nil if they are not encrypted
+func (conn *Conn) dataTLSConfig() *tls.Config {
+	if conn.protected {
+		return conn.tlsConfig
+	}
+	return nil
+}
+
 // receiveLine accepts a single line FTP command and co-ordinates an
 // appropriate response.
 func (conn *Conn) receiveLine(line string) {
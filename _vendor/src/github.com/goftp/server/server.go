@@ -49,6 +49,10 @@ type ServerOpts struct {
 	// If ture TLS is used in RFC4217 mode
 	ExplicitFTPS bool
 
+	// If true, users must secure the control connection (AUTH TLS)
+	// before logging in, and the data connections (PROT P) before transfers
+	ForceTLS bool
+
 	WelcomeMessage string
 }
 
@@ -105,6 +109,7 @@ func serverOptsWithDefaults(opts *ServerOpts) *ServerOpts {
 	newOpts.KeyFile = opts.KeyFile
 	newOpts.CertFile = opts.CertFile
 	newOpts.ExplicitFTPS = opts.ExplicitFTPS
+	newOpts.ForceTLS = opts.ForceTLS
 
 	newOpts.PublicIp = opts.PublicIp
 	newOpts.PassivePorts = opts.PassivePorts
@@ -156,6 +161,11 @@ func (server *Server) newConn(tcpConn net.Conn, driver Driver) *Conn {
 	c.sessionID = newSessionID()
 	c.logger = newLogger(c.sessionID)
 	c.tlsConfig = server.tlsConfig
+	if server.TLS && !server.ExplicitFTPS {
+		// implicit FTPS: everything is encrypted from the start
+		c.tls = true
+		c.protected = true
+	}
 	driver.Init(c)
 	return c
 }
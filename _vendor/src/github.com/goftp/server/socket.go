@@ -100,6 +100,7 @@ func newPassiveSocket(host string, port int, logger *Logger, tlsConfing *tls.Con
 	socket.logger = logger
 	socket.host = host
 	socket.port = port
+	socket.tlsConfing = tlsConfing
 	if err := socket.GoListenAndServe(); err != nil {
 		return nil, err
 	}
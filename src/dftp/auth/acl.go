@@ -0,0 +1,273 @@
+package auth
+
+/*
+* Per-path access control, shared by all public interfaces.
+*
+* Rules file consists of lines of two kinds (empty lines and lines starting with # are ignored):
+*   group <name> <login> [<login>...]
+*   <subject> <path prefix> <permissions>
+* where subject is a login, @group, `anonymous` (anonymous logins) or `*` (everybody),
+* and permissions are any of `r` (read files), `l` (see entries and list directories),
+* `w` (create, modify, rename and remove entries), or `-` for none.
+*
+* Of the rules matching the user and covering a given path, only the ones with the longest
+* prefix apply; the user is granted the union of their permissions. Paths not covered by any
+* rule matching the user are inaccessible. E.g.
+*   *         /          rl
+*   *         /finance   -
+*   @finance  /finance   rlw
+* lets everybody read everything except /finance, which is only accessible to the group.
+*
+* Without a rules file everything is allowed to everybody.
+* The file is reloaded when it changes, or upon Reload() call.
+ */
+
+import (
+	"bufio"
+	"dftp/utils"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type Permission uint8
+
+const (
+	ReadPermission Permission = 1 << iota
+	ListPermission
+	WritePermission
+)
+
+const (
+	// Name of the user who has not logged in, or has logged in anonymously
+	AnonymousUser = "anonymous"
+)
+
+var (
+	AccessDeniedError = fmt.Errorf("access denied")
+)
+
+type Acl struct {
+	sync.RWMutex
+	Path string
+
+	// group name -> set of logins
+	groups map[string]map[string]bool
+	// ordered by prefix length, longest first
+	rules []aclRule
+	watch fileWatch
+}
+
+type aclRule struct {
+	subject string
+	prefix  string
+	perms   Permission
+}
+
+func NewAcl(path string) (*Acl, error) {
+	acl := &Acl{
+		Path:  path,
+		watch: fileWatch{path: path},
+	}
+	if err := acl.Reload(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parsePermissions(s string) (Permission, error) {
+	var perms Permission
+	if s == "-" {
+		return perms, nil
+	}
+	for _, c := range s {
+		switch c {
+		case 'r':
+			perms |= ReadPermission
+		case 'l':
+			perms |= ListPermission
+		case 'w':
+			perms |= WritePermission
+		default:
+			return 0, fmt.Errorf("unknown permission `%c` (use r, l, w or -)", c)
+		}
+	}
+	return perms, nil
+}
+
+// Path inside DFS, without leading and trailing slashes
+func normalizeAclPath(path string) string {
+	return strings.Trim(filepath.Clean("/"+path), "/")
+}
+
+// Returns true if the prefix covers the path
+func covers(prefix string, path string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Reads the rules file again
+func (a *Acl) Reload() error {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string]map[string]bool)
+	rules := make([]aclRule, 0)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "group" {
+			if len(fields) < 3 {
+				return fmt.Errorf("%s:%d: expected group <name> <login>...", a.Path, lineNo)
+			}
+			members, ok := groups[fields[1]]
+			if !ok {
+				members = make(map[string]bool)
+				groups[fields[1]] = members
+			}
+			for _, login := range fields[2:] {
+				members[login] = true
+			}
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected <subject> <path> <permissions>", a.Path, lineNo)
+		}
+		perms, err := parsePermissions(fields[2])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", a.Path, lineNo, err)
+		}
+		rules = append(rules, aclRule{
+			subject: fields[0],
+			prefix:  normalizeAclPath(fields[1]),
+			perms:   perms,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if strings.HasPrefix(rule.subject, "@") && groups[rule.subject[1:]] == nil {
+			log.Printf("WARN: Auth: %s: group `%s` is not defined", a.Path, rule.subject[1:])
+		}
+	}
+	utils.SortSlice(rules, func(l, r interface{}) bool {
+		return len(l.(aclRule).prefix) > len(r.(aclRule).prefix)
+	})
+
+	a.Lock()
+	a.groups = groups
+	a.rules = rules
+	a.Unlock()
+	a.watch.loaded(info)
+	log.Printf("Auth: loaded %d access rule(s) from %s", len(rules), a.Path)
+	return nil
+}
+
+// Reloads the rules file if it has changed since the last check
+func (a *Acl) reloadIfChanged() {
+	if !a.watch.changed() {
+		return
+	}
+	if err := a.Reload(); err != nil {
+		log.Printf("ERROR: Auth: cannot reload access rules, keeping previous ones: %s", err)
+	}
+}
+
+// Must be called with the read lock held
+func (a *Acl) matches(subject string, user string) bool {
+	switch {
+	case subject == "*":
+		return true
+	case subject == AnonymousUser:
+		return user == "" || IsAnonymous(user)
+	case strings.HasPrefix(subject, "@"):
+		return !IsAnonymous(user) && a.groups[subject[1:]][user]
+	}
+	return user == subject && !IsAnonymous(user)
+}
+
+// Must be called with the read lock held
+func (a *Acl) permissions(user string, path string) Permission {
+	var perms Permission
+	longest := -1
+	for _, rule := range a.rules {
+		if len(rule.prefix) < longest {
+			break
+		}
+		if !covers(rule.prefix, path) || !a.matches(rule.subject, user) {
+			continue
+		}
+		longest = len(rule.prefix)
+		perms |= rule.perms
+	}
+	return perms
+}
+
+// Returns true if the user has the permission on the path.
+// A nil Acl allows everything.
+func (a *Acl) Allowed(user string, path string, perm Permission) bool {
+	if a == nil {
+		return true
+	}
+	a.reloadIfChanged()
+	a.RLock()
+	defer a.RUnlock()
+	return a.permissions(user, normalizeAclPath(path))&perm == perm
+}
+
+// Returns true if the user has the permission on the path and everything under it
+func (a *Acl) AllowedTree(user string, path string, perm Permission) bool {
+	if a == nil {
+		return true
+	}
+	a.reloadIfChanged()
+	a.RLock()
+	defer a.RUnlock()
+	path = normalizeAclPath(path)
+	if a.permissions(user, path)&perm != perm {
+		return false
+	}
+	for _, rule := range a.rules {
+		if rule.prefix != path && covers(path, rule.prefix) && a.permissions(user, rule.prefix)&perm != perm {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the entry at path should be shown to the user: either it may be listed,
+// or it leads to something the user has access to
+func (a *Acl) Visible(user string, path string) bool {
+	if a == nil {
+		return true
+	}
+	a.reloadIfChanged()
+	a.RLock()
+	defer a.RUnlock()
+	path = normalizeAclPath(path)
+	if a.permissions(user, path)&ListPermission != 0 {
+		return true
+	}
+	for _, rule := range a.rules {
+		if rule.prefix != path && covers(path, rule.prefix) && a.permissions(user, rule.prefix) != 0 {
+			return true
+		}
+	}
+	return false
+}
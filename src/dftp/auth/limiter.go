@@ -0,0 +1,128 @@
+package auth
+
+/*
+* Failed login rate limiting.
+*
+* Failures are counted per login and client address, so that guessing passwords from one
+* address does not lock the user out everywhere else.
+* After MaxFailedLogins consecutive failures a login is locked out (for that address) for
+* LoginLockout; every further lockout lasts twice as long (up to MaxLoginLockout).
+* A successful login resets the counters.
+ */
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MaxFailedLogins  = 5
+	LoginLockout     = 1 * time.Minute
+	MaxLoginLockout  = 1 * time.Hour
+	FailedLoginDelay = 1 * time.Second
+	// failure counters of logins not seen for this long are forgotten
+	loginFailureMemory = 24 * time.Hour
+	// old failure counters are looked for at most that often
+	loginForgetPeriod = 1 * time.Minute
+	// at most that many failure counters are kept; the least recently failed ones are dropped first
+	maxLoginFailures = 10000
+)
+
+type loginLimiter struct {
+	sync.Mutex
+	logins     map[loginKey]*loginFailures
+	lastForget time.Time
+}
+
+type loginKey struct {
+	login string
+	addr  string
+}
+
+type loginFailures struct {
+	failures    int
+	lockouts    uint
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		logins: make(map[loginKey]*loginFailures),
+	}
+}
+
+// Returns the end of the lockout, or zero time if the login is not locked out for the address
+func (l *loginLimiter) lockedUntil(login string, addr string) time.Time {
+	l.Lock()
+	defer l.Unlock()
+	f, ok := l.logins[loginKey{login, addr}]
+	if !ok || time.Now().After(f.lockedUntil) {
+		return time.Time{}
+	}
+	return f.lockedUntil
+}
+
+// Records a failure; returns the end of the lockout if the login has just been locked out
+func (l *loginLimiter) failed(login string, addr string) time.Time {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastForget) > loginForgetPeriod {
+		l.forgetOld(now)
+		l.lastForget = now
+	}
+	key := loginKey{login, addr}
+	f, ok := l.logins[key]
+	if !ok {
+		if len(l.logins) >= maxLoginFailures {
+			l.forgetLeastRecent()
+		}
+		f = &loginFailures{}
+		l.logins[key] = f
+	}
+	f.failures += 1
+	f.lastFailure = now
+	if f.failures < MaxFailedLogins {
+		return time.Time{}
+	}
+	lockout := LoginLockout << f.lockouts
+	if lockout > MaxLoginLockout || lockout <= 0 {
+		lockout = MaxLoginLockout
+	}
+	f.failures = 0
+	f.lockouts += 1
+	f.lockedUntil = now.Add(lockout)
+	return f.lockedUntil
+}
+
+func (l *loginLimiter) succeeded(login string, addr string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.logins, loginKey{login, addr})
+}
+
+// Must be called with the mutex held
+func (l *loginLimiter) forgetOld(now time.Time) {
+	for key, f := range l.logins {
+		if now.Sub(f.lastFailure) > loginFailureMemory && now.After(f.lockedUntil) {
+			delete(l.logins, key)
+		}
+	}
+}
+
+// Must be called with the mutex held
+func (l *loginLimiter) forgetLeastRecent() {
+	var oldest *loginKey
+	var oldestT time.Time
+	for key, f := range l.logins {
+		if oldest == nil || f.lastFailure.Before(oldestT) {
+			k := key
+			oldest = &k
+			oldestT = f.lastFailure
+		}
+	}
+	if oldest != nil {
+		delete(l.logins, *oldest)
+	}
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often configuration files are checked for changes
+	ReloadCheckPeriod = 5 * time.Second
+)
+
+// Tells when a configuration file has changed and should be reloaded
+type fileWatch struct {
+	sync.Mutex
+	path        string
+	modTime     time.Time
+	lastChecked time.Time
+}
+
+// Records modification time of the file which has just been loaded
+func (w *fileWatch) loaded(info os.FileInfo) {
+	w.Lock()
+	defer w.Unlock()
+	w.modTime = info.ModTime()
+	w.lastChecked = time.Now()
+}
+
+// Returns true if the file has changed since it was loaded.
+// The file is actually checked at most once per ReloadCheckPeriod.
+func (w *fileWatch) changed() bool {
+	if w.path == "" {
+		return false
+	}
+	w.Lock()
+	if time.Since(w.lastChecked) < ReloadCheckPeriod {
+		w.Unlock()
+		return false
+	}
+	w.lastChecked = time.Now()
+	modTime := w.modTime
+	w.Unlock()
+
+	info, err := os.Stat(w.path)
+	return err == nil && !info.ModTime().Equal(modTime)
+}
+
+// Reads a file of `login:value` lines (empty lines and lines starting with # are ignored),
+// calling `add` for every pair
+func readLoginFile(path string, valueName string, add func(lineNo int, login string, value string)) (os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected login:%s", path, lineNo, valueName)
+		}
+		add(lineNo, parts[0], parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,85 @@
+package auth
+
+/*
+* Signed expiring URLs.
+*
+* A signed URL lets anyone holding it read a single path on behalf of a user until the URL expires.
+* The signature is HMAC-SHA256 of the path, user and expiry time, keyed by a secret shared
+* by every node of the cluster, so a link minted by one node is accepted by all of them.
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MinSigningKeyLength = 16
+	DefaultSignedUrlTTL = 1 * time.Hour
+)
+
+var (
+	InvalidSignatureError = fmt.Errorf("invalid URL signature")
+	ExpiredSignatureError = fmt.Errorf("signed URL has expired")
+)
+
+type UrlSigner struct {
+	key []byte
+}
+
+// Reads the signing key from the file
+func NewUrlSigner(keyPath string) (*UrlSigner, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) < MinSigningKeyLength {
+		return nil, fmt.Errorf("%s: signing key must be at least %d bytes long", keyPath, MinSigningKeyLength)
+	}
+	return &UrlSigner{key: key}, nil
+}
+
+func (s *UrlSigner) signature(path string, user string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "%s\n%s\n%d", normalizeAclPath(path), user, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns query parameters granting the user access to the path until `expires`
+func (s *UrlSigner) Sign(path string, user string, expires time.Time) url.Values {
+	vals := url.Values{}
+	vals.Set("user", user)
+	vals.Set("expires", fmt.Sprintf("%d", expires.Unix()))
+	vals.Set("signature", s.signature(path, user, expires.Unix()))
+	return vals
+}
+
+// Returns true if the query parameters contain a signature
+func IsSigned(vals url.Values) bool {
+	return vals.Get("signature") != ""
+}
+
+// Checks the signature of the query parameters for the path; returns the user they grant access for
+func (s *UrlSigner) Verify(path string, vals url.Values) (string, error) {
+	user := vals.Get("user")
+	expires, err := strconv.ParseInt(vals.Get("expires"), 10, 64)
+	if err != nil {
+		return "", InvalidSignatureError
+	}
+	expected := s.signature(path, user, expires)
+	if !hmac.Equal([]byte(expected), []byte(vals.Get("signature"))) {
+		return "", InvalidSignatureError
+	}
+	if time.Now().Unix() > expires {
+		return "", ExpiredSignatureError
+	}
+	return user, nil
+}
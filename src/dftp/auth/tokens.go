@@ -0,0 +1,84 @@
+package auth
+
+/*
+* Static API tokens.
+*
+* Tokens are read from a file of `login:token` lines; empty lines and lines starting with # are ignored.
+* A login may have several tokens. The file is reloaded when it changes, or upon Reload() call.
+ */
+
+import (
+	"crypto/sha256"
+	"log"
+	"sync"
+)
+
+const (
+	MinTokenLength = 16
+)
+
+type TokenDb struct {
+	sync.RWMutex
+	Path string
+
+	// digest of the token -> login; looking tokens up by their digests
+	// does not reveal how much of a wrong token matches a valid one
+	tokens map[[sha256.Size]byte]string
+	watch  fileWatch
+}
+
+func NewTokenDb(path string) (*TokenDb, error) {
+	db := &TokenDb{
+		Path:  path,
+		watch: fileWatch{path: path},
+	}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reads the tokens file again
+func (db *TokenDb) Reload() error {
+	tokens := make(map[[sha256.Size]byte]string)
+	info, err := readLoginFile(db.Path, "token", func(lineNo int, login string, token string) {
+		if len(token) < MinTokenLength {
+			log.Printf("WARN: Auth: %s:%d: token of `%s` skipped, tokens must be at least %d characters long", db.Path, lineNo, login, MinTokenLength)
+			return
+		}
+		tokens[sha256.Sum256([]byte(token))] = login
+	})
+	if err != nil {
+		return err
+	}
+
+	db.Lock()
+	db.tokens = tokens
+	db.Unlock()
+	db.watch.loaded(info)
+	log.Printf("Auth: loaded %d API token(s) from %s", len(tokens), db.Path)
+	return nil
+}
+
+// Reloads the tokens file if it has changed since the last check
+func (db *TokenDb) reloadIfChanged() {
+	if !db.watch.changed() {
+		return
+	}
+	if err := db.Reload(); err != nil {
+		log.Printf("ERROR: Auth: cannot reload API tokens, keeping previous ones: %s", err)
+	}
+}
+
+// Returns the login the token belongs to. `origin` describes where the attempt comes from (for logging).
+func (db *TokenDb) Authenticate(token string, origin string) (string, bool) {
+	db.reloadIfChanged()
+	db.RLock()
+	login, ok := db.tokens[sha256.Sum256([]byte(token))]
+	db.RUnlock()
+	if !ok {
+		log.Printf("Auth: invalid API token (%s)", origin)
+		return "", false
+	}
+	return login, true
+}
@@ -0,0 +1,154 @@
+package auth
+
+/*
+* User database for public interfaces.
+*
+* Users are read from an htpasswd-style file: one `login:bcrypt hash` pair per line
+* (e.g. made by `htpasswd -B`); empty lines and lines starting with # are ignored.
+* The file is reloaded when it changes, or upon Reload() call.
+*
+* HTTP clients send the password with every request, so verified passwords are remembered
+* (as salted digests) until the file is reloaded, and bcrypt runs only once per login.
+*
+* Anonymous login (as `anonymous` or `ftp`, with any password) is allowed only if enabled explicitly.
+ */
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	anonymousLogins = map[string]bool{"anonymous": true, "ftp": true}
+)
+
+type UserDb struct {
+	sync.RWMutex
+	// htpasswd-style file; empty if there are no registered users
+	Path      string
+	Anonymous bool
+
+	users   map[string][]byte
+	watch   fileWatch
+	limiter *loginLimiter
+	// login -> digest of the password verified last
+	verified map[string][sha256.Size]byte
+	salt     []byte
+}
+
+func NewUserDb(path string, anonymous bool) (*UserDb, error) {
+	db := &UserDb{
+		Path:      path,
+		Anonymous: anonymous,
+		users:     make(map[string][]byte),
+		watch:     fileWatch{path: path},
+		limiter:   newLoginLimiter(),
+		verified:  make(map[string][sha256.Size]byte),
+		salt:      make([]byte, 16),
+	}
+	if _, err := rand.Read(db.salt); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := db.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	if path == "" && !anonymous {
+		log.Printf("WARN: Auth: no users file and anonymous login disabled, nobody can log in")
+	}
+	return db, nil
+}
+
+// Reads the users file again
+func (db *UserDb) Reload() error {
+	if db.Path == "" {
+		return nil
+	}
+	users := make(map[string][]byte)
+	info, err := readLoginFile(db.Path, "hash", func(lineNo int, login string, hash string) {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			log.Printf("WARN: Auth: %s:%d: user `%s` skipped, only bcrypt hashes are supported", db.Path, lineNo, login)
+			return
+		}
+		users[login] = []byte(hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	db.Lock()
+	db.users = users
+	db.verified = make(map[string][sha256.Size]byte)
+	db.Unlock()
+	db.watch.loaded(info)
+	log.Printf("Auth: loaded %d user(s) from %s", len(users), db.Path)
+	return nil
+}
+
+// Reloads the users file if it has changed since the last check
+func (db *UserDb) reloadIfChanged() {
+	if !db.watch.changed() {
+		return
+	}
+	if err := db.Reload(); err != nil {
+		log.Printf("ERROR: Auth: cannot reload users, keeping previous ones: %s", err)
+	}
+}
+
+func IsAnonymous(login string) bool {
+	return anonymousLogins[login]
+}
+
+// Checks login and password. `origin` describes where the attempt comes from (for logging);
+// failed attempts are limited per login and client address `addr` (see limiter.go).
+func (db *UserDb) Authenticate(login string, password string, origin string, addr string) bool {
+	if IsAnonymous(login) {
+		if db.Anonymous {
+			log.Printf("Auth: anonymous login (%s)", origin)
+			return true
+		}
+		log.Printf("Auth: anonymous login refused (%s)", origin)
+		return false
+	}
+
+	db.reloadIfChanged()
+	digest := sha256.Sum256(append(append([]byte{}, db.salt...), password...))
+	db.RLock()
+	hash, ok := db.users[login]
+	known, wasVerified := db.verified[login]
+	db.RUnlock()
+	// the password has been verified before, so guesses of others cannot lock the user out
+	if ok && wasVerified && subtle.ConstantTimeCompare(known[:], digest[:]) == 1 {
+		return true
+	}
+
+	if until := db.limiter.lockedUntil(login, addr); !until.IsZero() {
+		log.Printf("Auth: login `%s` refused, locked out until %s (%s)", login, until.Format(time.RFC3339), origin)
+		return false
+	}
+	if ok && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+		db.Lock()
+		if string(db.users[login]) == string(hash) {
+			db.verified[login] = digest
+		}
+		db.Unlock()
+		db.limiter.succeeded(login, addr)
+		log.Printf("Auth: user `%s` logged in (%s)", login, origin)
+		return true
+	}
+
+	if until := db.limiter.failed(login, addr); !until.IsZero() {
+		log.Printf("Auth: login `%s` failed, locked out until %s (%s)", login, until.Format(time.RFC3339), origin)
+	} else {
+		log.Printf("Auth: login `%s` failed (%s)", login, origin)
+	}
+	time.Sleep(FailedLoginDelay)
+	return false
+}
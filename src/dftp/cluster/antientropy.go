@@ -0,0 +1,237 @@
+package cluster
+
+/*
+* Anti-entropy.
+*
+* Updates are pushed to every node directly, and lost ones are requested again (see
+* communication.go), but a node may still end up without some replicas: e.g. if the owner
+* dies before the node has pulled the updates it missed. Every AntiEntropyPeriod a node
+* compares its tree with the tree of a random peer, and takes the replicas it has missed.
+*
+* Trees are compared top-down by hashes (see dfsfat/merkle.go): starting from the root, the node
+* asks the peer for the hashes of an entry and of its children (GET /merkle/), and descends only
+* into children whose hashes differ from its own. Subtrees the node has no trace of are
+* requested as a whole, unless they are too large; those are descended into level by level,
+* a directory listing at a time. Replicas received this way are merged as any others, newer versions
+* winning, so nodes relay information about third nodes to each other. A node never takes
+* replicas of its own files from others, except tombstones.
+*
+* Only the node which makes the comparison is repaired; the peer repairs itself when it picks
+* the node in turn.
+ */
+
+import (
+	"dftp/dfsfat"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	AntiEntropyPeriod = 1 * time.Minute
+	// Maximum number of requests of a single round; remaining differences are left to next rounds
+	AntiEntropyMaxRequests = 100
+	// Maximum number of replicas of a subtree requested as a whole
+	AntiEntropyMaxExport = 1000
+)
+
+var (
+	TooManyDifferencesError = fmt.Errorf("too many differences, the rest is left to next rounds")
+)
+
+// Response to GET /merkle/
+type MerkleEntry struct {
+	dfsfat.EntryHashes
+	// Every replica inside the entry, if requested
+	Files []*dfsfat.FileAnnouncement `json:",omitempty"`
+	// Set if the replicas have been requested, but there are too many of them;
+	// Files then lists only the replicas of the children (if not too many either)
+	TooLarge bool `json:",omitempty"`
+}
+
+type antiEntropyRound struct {
+	c        *Cluster
+	addr     string
+	requests int
+	// replicas to take
+	files []*dfsfat.FileAnnouncement
+}
+
+// Starts comparing the tree with a random peer every `period`
+func (c *Cluster) StartAntiEntropy(period time.Duration) {
+	go func() {
+		for _ = range time.NewTicker(period).C {
+			peers := c.randomPeers(1, "")
+			if len(peers) == 0 {
+				continue
+			}
+			if err := c.AntiEntropy(peers[0]); err != nil {
+				log.Printf("Error comparing tree with %s: %s", peers[0].Name, err)
+			}
+		}
+	}()
+}
+
+// Compares the tree with the tree of the node, and takes the replicas we have missed
+func (c *Cluster) AntiEntropy(node *NodeInfo) error {
+	round := &antiEntropyRound{
+		c:    c,
+		addr: node.memberState().MgmtAddr,
+	}
+	err := round.compare("")
+	if err == TooManyDifferencesError {
+		log.Printf("Anti-entropy with %s: %s", node.Name, err)
+		err = nil
+	}
+	if round.requests > 1 {
+		log.Printf("Anti-entropy with %s: %d request(s), %d replica(s) received", node.Name, round.requests, len(round.files))
+	}
+	if len(round.files) > 0 {
+		round.apply()
+	}
+	return err
+}
+
+func (r *antiEntropyRound) compare(path string) error {
+	remote, err := r.fetch(path, false)
+	if err != nil || remote == nil {
+		return err
+	}
+	local := &dfsfat.EntryHashes{}
+	if entry := r.c.DfsRoot.Seek(path); entry != nil {
+		local = entry.GetHashes()
+	}
+	if local.Hash == remote.Hash {
+		return nil
+	}
+
+	for i := range remote.Replicas {
+		r.take(&dfsfat.FileAnnouncement{FullName: path, FileStat: remote.Replicas[i]})
+	}
+	for name, hash := range remote.Children {
+		localHash, ok := local.Children[name]
+		if ok && localHash == hash {
+			continue
+		}
+		childPath := name
+		if path != "" {
+			childPath = path + "/" + name
+		}
+		if ok {
+			err = r.compare(childPath)
+		} else {
+			err = r.takeSubtree(childPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Takes every replica inside an entry we know nothing about
+func (r *antiEntropyRound) takeSubtree(path string) error {
+	remote, err := r.fetch(path, true)
+	if err != nil || remote == nil {
+		return err
+	}
+	if !remote.TooLarge {
+		for _, fa := range remote.Files {
+			r.take(fa)
+		}
+		return nil
+	}
+	for i := range remote.Replicas {
+		r.take(&dfsfat.FileAnnouncement{FullName: path, FileStat: remote.Replicas[i]})
+	}
+	// descend only into directories, if the children are listed
+	dirs := make(map[string]bool)
+	for _, fa := range remote.Files {
+		r.take(fa)
+		if fa.Dir {
+			dirs[fa.FullName] = true
+		}
+	}
+	for name := range remote.Children {
+		childPath := name
+		if path != "" {
+			childPath = path + "/" + name
+		}
+		if remote.Files != nil && !dirs[childPath] {
+			continue
+		}
+		if err := r.takeSubtree(childPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the replicas of the children of the entry at `path`, or nil if there are more than `limit` of them
+func (c *Cluster) exportChildren(path string, children map[string]string, limit int) []*dfsfat.FileAnnouncement {
+	files := make([]*dfsfat.FileAnnouncement, 0)
+	for name := range children {
+		childPath := name
+		if path != "" {
+			childPath = path + "/" + name
+		}
+		entry := c.DfsRoot.Seek(childPath)
+		if entry == nil {
+			continue
+		}
+		for _, replica := range entry.GetHashes().Replicas {
+			files = append(files, &dfsfat.FileAnnouncement{FullName: childPath, FileStat: replica})
+		}
+		if len(files) > limit {
+			return nil
+		}
+	}
+	return files
+}
+
+func (r *antiEntropyRound) take(fa *dfsfat.FileAnnouncement) {
+	// we know better which files we have
+	if fa.OwnerNode == r.c.Me.Name && !fa.IsDeleted() {
+		return
+	}
+	fa.Deletion = false
+	r.files = append(r.files, fa)
+}
+
+// Returns hashes of the entry of the peer's tree (and every replica inside it if `export` is set),
+// or nil if the entry does not exist
+func (r *antiEntropyRound) fetch(path string, export bool) (*MerkleEntry, error) {
+	if r.requests >= AntiEntropyMaxRequests {
+		return nil, TooManyDifferencesError
+	}
+	r.requests++
+	vals := url.Values{}
+	vals.Set("path", "/"+path)
+	if export {
+		vals.Set("export", "true")
+	}
+	resp, body, err := r.c.mgmtRequest("GET", r.addr, "/merkle/?"+vals.Encode(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// removed in the meantime
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d (%s)", resp.StatusCode, string(body))
+	}
+	entry := &MerkleEntry{}
+	if err := json.Unmarshal(body, entry); err != nil {
+		return nil, fmt.Errorf("cannot decode hashes of /%s: %s", path, err)
+	}
+	return entry, nil
+}
+
+func (r *antiEntropyRound) apply() {
+	r.c.observeUpdate(&UpdateData{Files: r.files})
+	r.c.DfsRoot.Update(r.files)
+}
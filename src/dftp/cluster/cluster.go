@@ -1,6 +1,7 @@
 package cluster
 
 import (
+	"dftp/auth"
 	"dftp/dfsfat"
 	"dftp/httputils"
 	"dftp/localfs"
@@ -19,7 +20,21 @@ type Cluster struct {
 	DfsRoot *dfsfat.TreeNode
 	LocalFs *localfs.LocalFs
 
-	Proxy *Proxy
+	Proxy     *Proxy
+	UpdateLog *UpdateLog
+	// Chooses nodes to create new files on
+	Placement PlacementPolicy
+	// Signs download links for the public HTTP interface; nil if disabled
+	UrlSigner *auth.UrlSigner
+	// Public interfaces of the nodes use HTTPS
+	PublicTLS bool
+
+	// nil if mutual TLS is disabled
+	tls *clusterTLS
+	// nil if management requests are not signed
+	signer *messageSigner
+	// membership changes to piggyback on probes
+	gossip *gossipQueue
 
 	client *http.Client
 
@@ -30,6 +45,8 @@ type PublicClusterInfo struct {
 	Name string
 	Me    *NodeInfo
 	Peers map[string]*NodeInfo
+	// Sender's hybrid logical clock
+	Clock dfsfat.HLCTimestamp
 }
 
 const (
@@ -47,8 +64,31 @@ type NodeInfo struct {
 	LastUpdatePushed       int64
 	LastUpdateReceived     int64
 	LastFullUpdateReceived int64
-	GreetState             int `json:"-"`
-	PushState              int `json:"-"`
+	Liveness               int
+	// Increased only by the node itself (see membership.go)
+	Incarnation int64
+	// Sequence numbers of updates (see UpdateLog).
+	// For this node: current epoch and sequence of local changes.
+	// For peers: last update pushed to the peer (within our epoch),
+	// and last update received from the peer (within the peer's epoch).
+	UpdateEpoch             int64
+	LastUpdatePushedSeq     int64
+	LastUpdateReceivedEpoch int64
+	LastUpdateReceivedSeq   int64
+	PushState               int `json:"-"`
+
+	// Path inside DFS where the node's local tree is mounted
+	DfsMountPoint string
+	// Bytes available for new files on the node (-1 if unknown)
+	FreeSpace int64
+
+	pushAgain         bool // local changes arrived while a push was in progress
+	pushingFull       bool
+	fullPushRequested bool
+	pulling           bool
+	receiving         bool          // pushed updates are being applied
+	receivedUpdates   []*UpdateData // pushed updates waiting to be applied, in order of arrival
+	suspectSince      time.Time
 }
 
 func (n *NodeInfo) GetName() string {
@@ -58,26 +98,40 @@ func (n *NodeInfo) GetName() string {
 	return n.Name
 }
 
-func New(dfs *dfsfat.TreeNode, localfs *localfs.LocalFs, clusterName string, publicAddr string, mgmtAddr string, multicastAddr string) *Cluster {
+func New(dfs *dfsfat.TreeNode, localfs *localfs.LocalFs, clusterName string, publicAddr string, mgmtAddr string) *Cluster {
 	c := &Cluster{}
 	c.Name = clusterName
 	c.DfsRoot = dfs
 	c.LocalFs = localfs
 	c.Proxy = NewProxy(c, localfs)
+	c.UpdateLog = NewUpdateLog()
 	c.Peers = make(map[string]*NodeInfo)
+	c.gossip = newGossipQueue()
 	c.Me = &NodeInfo{
-		Name:       localfs.MyNodeName,
-		PublicAddr: publicAddr,
-		MgmtAddr:   mgmtAddr,
-		LastAlive:  time.Now().Unix(),
+		Name:        localfs.MyNodeName,
+		PublicAddr:  publicAddr,
+		MgmtAddr:    mgmtAddr,
+		LastAlive:   time.Now().Unix(),
+		UpdateEpoch: c.UpdateLog.Epoch,
+		// greater than incarnations of previous runs
+		Incarnation: time.Now().UnixNano() / int64(time.Millisecond),
+
+		DfsMountPoint: localfs.DfsMountPoint,
+		FreeSpace:     localfs.FreeSpace(),
 	}
+	c.Placement = ParentOwnerPlacement
 	c.client = httputils.MakeTimeoutingHttpClient(10 * time.Second)
-	if multicastAddr != "" {
-		c.StartMulticastDiscovery(multicastAddr)
-	}
+	localfs.OnChange = c.LocalChanged
+	localfs.OnScanned = c.LocalScanned
 	return c
 }
 
+// Starts probing peers and spreading membership changes. Called after the cluster
+// has been configured, before discovery is started.
+func (c *Cluster) Start() {
+	c.StartGossip()
+}
+
 func (c *Cluster) KnownMgmtAdr(addr string) bool {
 	c.RLock()
 	defer c.RUnlock()
@@ -5,105 +5,102 @@ import (
 	"dftp/dfsfat"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func (c *Cluster) GreetNode(addr string, node *NodeInfo, requestFullUpdate bool) {
+// Greets the node at `addr`: introduces this node to it, and learns the nodes it knows.
+// Returns true if the greeting has been successful.
+func (c *Cluster) GreetNode(addr string, node *NodeInfo, requestFullUpdate bool) bool {
 	log.Printf("Greeting %s (%s)...", node.GetName(), addr)
+	if err := c.greet(addr, requestFullUpdate); err != nil {
+		log.Printf("Error greeting %s: %s", addr, err)
+		return false
+	}
+	return true
+}
+
+func (c *Cluster) greet(addr string, requestFullUpdate bool) error {
+	me := c.Me.memberState()
 	vals := url.Values{}
-	vals.Set("name", c.Me.Name)
-	vals.Set("public-addr", c.Me.PublicAddr)
-	vals.Set("mgmt-addr", c.Me.MgmtAddr)
+	vals.Set("name", me.Name)
+	vals.Set("cluster-name", c.Name)
+	vals.Set("public-addr", me.PublicAddr)
+	vals.Set("mgmt-addr", me.MgmtAddr)
+	vals.Set("dfs-mount", me.DfsMountPoint)
+	vals.Set("incarnation", fmt.Sprintf("%d", me.Incarnation))
+	vals.Set("clock", fmt.Sprintf("%d", c.LocalFs.Clock.Now()))
 	if requestFullUpdate {
 		vals.Set("request-full-update", "true")
 	}
 
-	r, err := c.client.PostForm(fmt.Sprintf("http://%s/cluster/", addr), vals)
+	r, body, err := c.mgmtRequest("POST", addr, "/cluster/", "application/x-www-form-urlencoded", []byte(vals.Encode()))
 	if err != nil {
-		log.Printf("Error communicating with %s: %s", addr, err)
-		return
+		return err
 	}
-	defer r.Body.Close()
 	if r.StatusCode != http.StatusOK {
-		s, _ := ioutil.ReadAll(r.Body)
-		log.Printf("Error communicating with %s: HTTP status %d (%s)", addr, r.StatusCode, string(s))
-		return
+		return fmt.Errorf("HTTP status %d (%s)", r.StatusCode, string(body))
 	}
-	decoder := json.NewDecoder(r.Body)
 
 	rInfo := PublicClusterInfo{}
-	err = decoder.Decode(&rInfo)
+	err = json.Unmarshal(body, &rInfo)
 	if err != nil {
-		log.Printf("Error decoding cluster info from %s: %s", addr, err)
-		return
+		return fmt.Errorf("cannot decode cluster info: %s", err)
+	}
+	if rInfo.Name != c.Name || rInfo.Me == nil {
+		return fmt.Errorf("it belongs to cluster `%s`, not `%s`", rInfo.Name, c.Name)
 	}
 
-	rInfo.Me.LastAlive = time.Now().Unix()
+	c.LocalFs.Clock.Observe(rInfo.Clock)
 	rInfo.Me.MgmtAddr = addr
 	rInfo.Me.PublicAddr = combineHostAndPort(addr, rInfo.Me.PublicAddr)
-	rInfo.Me.GreetState = StateDone
-	rInfo.Peers[rInfo.Me.Name] = rInfo.Me
+	// the peer spreads the news about us itself
+	c.mergeMember(rInfo.Me.memberState(), rInfo.Me.Name, false)
 	for _, p := range rInfo.Peers {
-		c.UpdateNode(p)
-	}
-}
-
-func (c *Cluster) UpdateNode(newinfo *NodeInfo) {
-	if newinfo.Name == c.Me.Name {
-		return
-	}
-	c.Lock()
-	node, ok := c.Peers[newinfo.Name]
-	if !ok {
-		log.Printf("Met new node: %s", newinfo.Name)
-		node = &NodeInfo{
-			Name: newinfo.Name,
-		}
-		c.Peers[newinfo.Name] = node
+		c.mergeMember(p.memberState(), rInfo.Me.Name, false)
 	}
-	c.Unlock()
 
-	node.Lock()
-	node.PublicAddr = newinfo.PublicAddr
-	node.MgmtAddr = newinfo.MgmtAddr
-	node.LastAlive = newinfo.LastAlive
-	if newinfo.GreetState == StateDone {
-		node.GreetState = newinfo.GreetState
-	}
-	node.Unlock()
-
-	if node.GreetState == StateNever {
-		c.ScheduleGreet(node)
-	}
-	if node.PushState == StateNever {
-		c.SchedulePush(node)
+	c.RLock()
+	node, ok := c.Peers[rInfo.Me.Name]
+	c.RUnlock()
+	if ok {
+		c.MarkAlive(node)
+		node.Lock()
+		node.FreeSpace = rInfo.Me.FreeSpace
+		node.Unlock()
 	}
-
+	return nil
 }
 
-func (c *Cluster) ScheduleGreet(node *NodeInfo) {
+// Schedules pushing local changes to the node.
+// Pushes to every node are serialized; changes made while a push is in progress
+// are sent right after it finishes.
+func (c *Cluster) SchedulePush(node *NodeInfo) {
 	node.Lock()
 	defer node.Unlock()
-	if node.GreetState != StateNever {
+	if node.PushState == StatePending {
+		node.pushAgain = true
 		return
 	}
-	node.GreetState = StatePending
-	go c.GreetNode(node.MgmtAddr, node, true)
+	node.PushState = StatePending
+	go c.PushUpdate(node)
 }
 
-func (c *Cluster) SchedulePush(node *NodeInfo) {
+// Schedules pushing a full update to the node, regardless of what was pushed before.
+func (c *Cluster) ScheduleFullPush(node *NodeInfo) {
 	node.Lock()
-	defer node.Unlock()
-	if node.PushState == StatePending {
+	// the very first push is always full
+	if node.PushState == StatePending && (node.pushingFull || node.LastUpdatePushed == 0) {
+		node.Unlock()
 		return
 	}
-	node.PushState = StatePending
-	go c.PushFullUpdate(node)
+	node.fullPushRequested = true
+	node.Unlock()
+	c.SchedulePush(node)
 }
 
 type UpdateData struct {
@@ -111,53 +108,164 @@ type UpdateData struct {
 	UpdateTime     int64
 	Full           bool
 	SenderNodeName string
+	// Sender's clock at the moment the update was made; for full updates, the version of the scan
+	// (replicas of the sender older than that and missing from the update are pruned)
+	Version dfsfat.HLCTimestamp
+	// Sender's update epoch and the sequence the receiver reaches by applying this update.
+	// Incremental updates contain changes made after SinceSeq.
+	Epoch    int64
+	Seq      int64
+	SinceSeq int64
 }
 
-func (c *Cluster) PushFullUpdate(node *NodeInfo) {
-	log.Printf("Pushing full update to %s...", node.Name)
+// Called by LocalFs after a batch of local changes has been applied to the local tree.
+func (c *Cluster) LocalChanged(files []*dfsfat.FileAnnouncement) {
+	c.UpdateLog.Append(files)
 
-	var buf bytes.Buffer
-	var err error
-	var r *http.Response
-	enc := json.NewEncoder(&buf)
+	for _, node := range c.GetPeers() {
+		node.Lock()
+		pushedBefore := node.PushState != StateNever
+		node.Unlock()
+		if pushedBefore {
+			c.SchedulePush(node)
+		}
+	}
+}
 
-	files, scanT := c.LocalFs.GetLastFullScan()
+// Makes an update containing every local change after sequence `since`.
+// Falls back to a full update if `full` is requested, or if the changes are no longer in the log.
+func (c *Cluster) makeUpdate(since int64, full bool) *UpdateData {
 	upd := &UpdateData{
-		Files:          files,
-		UpdateTime:     scanT,
-		Full:           true,
+		UpdateTime:     time.Now().Unix(),
 		SenderNodeName: c.Me.Name,
+		Epoch:          c.UpdateLog.Epoch,
 	}
-	err = enc.Encode(upd)
-	if err != nil {
-		goto fail
+	if !full {
+		files, seq, ok := c.UpdateLog.Since(since)
+		if ok {
+			upd.Files = files
+			upd.Seq = seq
+			upd.SinceSeq = since
+			upd.Version = c.LocalFs.Clock.Now()
+			return upd
+		}
 	}
-	r, err = c.client.Post(fmt.Sprintf("http://%s/update/", node.MgmtAddr), "application/json", &buf)
-	if err != nil {
-		goto fail
+	// sequence must be taken before the scan: changes in between will be sent again, but not lost
+	upd.Seq = c.UpdateLog.LastSeq()
+	upd.Files, upd.UpdateTime, upd.Version = c.LocalFs.GetLastFullScan()
+	upd.Full = true
+	return upd
+}
+
+// Called by LocalFs after the first full scan of the local tree
+func (c *Cluster) LocalScanned() {
+	for _, node := range c.GetPeers() {
+		node.Lock()
+		postponed := node.PushState == StateNever
+		node.Unlock()
+		if postponed {
+			c.SchedulePush(node)
+		}
 	}
-	defer r.Body.Close()
-	if r.StatusCode != http.StatusOK {
-		s, _ := ioutil.ReadAll(r.Body)
-		err = fmt.Errorf("HTTP status %d (%s)", r.StatusCode, string(s))
-		goto fail
+}
+
+func (c *Cluster) PushUpdate(node *NodeInfo) {
+	if !c.LocalFs.IsScanned() {
+		// nothing to push yet; LocalScanned() will reschedule
+		node.Lock()
+		node.PushState = StateNever
+		node.Unlock()
+		return
+	}
+
+	node.Lock()
+	full := node.fullPushRequested || node.LastUpdatePushed == 0
+	since := node.LastUpdatePushedSeq
+	node.fullPushRequested = false
+	node.pushAgain = false
+	node.pushingFull = full
+	node.Unlock()
+
+	upd := c.makeUpdate(since, full)
+	kind := "incremental"
+	if upd.Full {
+		kind = "full"
+	}
+
+	var err error
+	if upd.Full || upd.Seq != since {
+		log.Printf("Pushing %s update (files: %d, seq: %d) to %s...", kind, len(upd.Files), upd.Seq, node.Name)
+		err = c.postUpdate(node, upd)
+	}
+	if err != nil {
+		log.Printf("Error pushing %s update to %s: %s", kind, node.Name, err)
+		node.Lock()
+		node.PushState = StateNever
+		node.pushingFull = false
+		node.fullPushRequested = node.fullPushRequested || upd.Full
+		node.Unlock()
+		return
 	}
-	log.Printf("Pushed full update to %s", node.Name)
 
 	node.Lock()
 	node.PushState = StateDone
+	node.pushingFull = false
 	node.LastUpdatePushed = time.Now().Unix()
+	node.LastUpdatePushedSeq = upd.Seq
+	again := node.pushAgain
 	node.Unlock()
-	return
-fail:
-	log.Printf("Error pushing last update to %s: %s", node.Name, err)
+
+	if again {
+		c.SchedulePush(node)
+	}
+}
+
+func (c *Cluster) postUpdate(node *NodeInfo, upd *UpdateData) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	err := enc.Encode(upd)
+	if err != nil {
+		return err
+	}
+	r, body, err := c.mgmtRequest("POST", node.MgmtAddr, "/update/", "application/json", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %d (%s)", r.StatusCode, string(body))
+	}
+	return nil
+}
+
+// Applies updates pushed by the node one by one, in order of arrival,
+// so that a later update is not taken for one sent out of sequence
+func (c *Cluster) queueUpdate(node *NodeInfo, upd *UpdateData) {
 	node.Lock()
-	node.PushState = StateNever
+	node.receivedUpdates = append(node.receivedUpdates, upd)
+	start := !node.receiving
+	node.receiving = true
 	node.Unlock()
+	if !start {
+		return
+	}
+	go func() {
+		for {
+			node.Lock()
+			if len(node.receivedUpdates) == 0 {
+				node.receiving = false
+				node.Unlock()
+				return
+			}
+			upd := node.receivedUpdates[0]
+			node.receivedUpdates = node.receivedUpdates[1:]
+			node.Unlock()
+			c.ReceiveUpdate(upd)
+		}
+	}()
 }
 
 func (c *Cluster) ReceiveUpdate(upd *UpdateData) {
-	log.Printf("Received update (files: %d, full: %v) from %s", len(upd.Files), upd.Full, upd.SenderNodeName)
+	log.Printf("Received update (files: %d, full: %v, seq: %d) from %s", len(upd.Files), upd.Full, upd.Seq, upd.SenderNodeName)
 	c.RLock()
 	node, ok := c.Peers[upd.SenderNodeName]
 	c.RUnlock()
@@ -165,12 +273,88 @@ func (c *Cluster) ReceiveUpdate(upd *UpdateData) {
 		log.Printf("Warning: unknown update sender: %s", upd.SenderNodeName)
 		return
 	}
+	c.MarkAlive(node)
+	c.observeUpdate(upd)
+
+	node.Lock()
+	inSequence := upd.Full || (upd.Epoch == node.LastUpdateReceivedEpoch && upd.SinceSeq <= node.LastUpdateReceivedSeq)
+	node.Unlock()
+
 	c.DfsRoot.Update(upd.Files)
-	// TODO: if full update, remove older files owned by upd.SenderNodeName
+	if upd.Full {
+		// files missing from a full update have been removed on the sender
+		c.DfsRoot.Prune(upd.SenderNodeName, upd.Files, upd.Version)
+	}
+
 	node.Lock()
 	node.LastUpdateReceived = upd.UpdateTime
-	node.LastFullUpdateReceived = upd.UpdateTime
+	if upd.Full {
+		node.LastFullUpdateReceived = upd.UpdateTime
+	}
+	if inSequence {
+		if upd.Epoch != node.LastUpdateReceivedEpoch || upd.Seq > node.LastUpdateReceivedSeq {
+			node.LastUpdateReceivedEpoch = upd.Epoch
+			node.LastUpdateReceivedSeq = upd.Seq
+		}
+	}
+	lastSeq := node.LastUpdateReceivedSeq
 	node.Unlock()
+
+	if !inSequence {
+		log.Printf("Missed some updates from %s, requesting changes since seq %d", node.Name, lastSeq)
+		go c.PullUpdate(node)
+	}
+}
+
+// Moves local clock past every version in the update, so that later local changes
+// supersede the received information
+func (c *Cluster) observeUpdate(upd *UpdateData) {
+	latest := upd.Version
+	for _, fa := range upd.Files {
+		if fa.InfoVersion > latest {
+			latest = fa.InfoVersion
+		}
+	}
+	c.LocalFs.Clock.Observe(latest)
+}
+
+// Observes a clock value passed as a request parameter
+func (c *Cluster) observeClock(value string) {
+	t, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		c.LocalFs.Clock.Observe(dfsfat.HLCTimestamp(t))
+	}
+}
+
+// Asks the node for every change we have not received yet
+func (c *Cluster) PullUpdate(node *NodeInfo) {
+	node.Lock()
+	vals := url.Values{}
+	vals.Set("epoch", fmt.Sprintf("%d", node.LastUpdateReceivedEpoch))
+	vals.Set("since", fmt.Sprintf("%d", node.LastUpdateReceivedSeq))
+	addr := node.MgmtAddr
+	node.Unlock()
+
+	r, body, err := c.mgmtRequest("GET", addr, "/updates/?"+vals.Encode(), "", nil)
+	if err != nil {
+		log.Printf("Error requesting updates from %s: %s", node.Name, err)
+		return
+	}
+	if r.StatusCode != http.StatusOK {
+		log.Printf("Error requesting updates from %s: HTTP status %d (%s)", node.Name, r.StatusCode, string(body))
+		return
+	}
+	upd := &UpdateData{}
+	err = json.Unmarshal(body, upd)
+	if err != nil {
+		log.Printf("Error decoding updates from %s: %s", node.Name, err)
+		return
+	}
+	if upd.SenderNodeName != node.Name {
+		log.Printf("Error requesting updates from %s: got update from %s instead", node.Name, upd.SenderNodeName)
+		return
+	}
+	c.ReceiveUpdate(upd)
 }
 
 // returns <addr1.host>:<addr2.port>
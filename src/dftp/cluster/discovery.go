@@ -0,0 +1,264 @@
+package cluster
+
+/*
+* Peer discovery from configured sources: a static list of addresses, DNS names and a peers file.
+*
+* Every source is looked up periodically (DNS names and the file may change). Host names are
+* resolved to every address they have, and addresses without a port get the port of our own
+* management interface. Addresses of unknown peers are greeted; failed greetings are retried
+* with exponential backoff, so that nodes started in any order find each other.
+*
+* Multicast discovery (see multicastdiscovery.go) works alongside, if enabled.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	PeerLookupPeriod = 1 * time.Minute
+	// Backoff of greeting retries of an address
+	GreetRetryMin = 5 * time.Second
+	GreetRetryMax = 5 * time.Minute
+)
+
+// Source of management addresses of peers
+type PeerSource interface {
+	// Returns addresses in form host:port or host
+	Lookup() ([]string, error)
+	String() string
+}
+
+// Fixed list of addresses
+type StaticPeers struct {
+	Addrs []string
+}
+
+func (s *StaticPeers) Lookup() ([]string, error) {
+	return s.Addrs, nil
+}
+
+func (s *StaticPeers) String() string {
+	return "static peers"
+}
+
+// DNS name: SRV records of `_service._proto.name`, or A/AAAA records of a host name
+// (with an optional port)
+type DnsPeers struct {
+	Name string
+}
+
+func (s *DnsPeers) Lookup() ([]string, error) {
+	if !strings.HasPrefix(s.Name, "_") {
+		// host names are resolved by the caller
+		return []string{s.Name}, nil
+	}
+	_, records, err := net.LookupSRV("", "", s.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(records))
+	for i, rec := range records {
+		addrs[i] = net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), fmt.Sprintf("%d", rec.Port))
+	}
+	return addrs, nil
+}
+
+func (s *DnsPeers) String() string {
+	return "DNS " + s.Name
+}
+
+// File with an address per line; empty lines and lines starting with # are ignored
+type PeersFile struct {
+	Path string
+}
+
+func (s *PeersFile) Lookup() ([]string, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	addrs := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, scanner.Err()
+}
+
+func (s *PeersFile) String() string {
+	return "peers file " + s.Path
+}
+
+type peerDiscovery struct {
+	c       *Cluster
+	sources []PeerSource
+	period  time.Duration
+
+	// last successfully looked up addresses of every source
+	found map[PeerSource][]string
+	// addresses greeting of which has failed
+	retries map[string]*greetRetry
+}
+
+type greetRetry struct {
+	failures int
+	next     time.Time
+}
+
+// Starts looking up the sources every `period`, and greeting the peers found
+func (c *Cluster) StartPeerDiscovery(sources []PeerSource, period time.Duration) {
+	if period <= 0 {
+		period = PeerLookupPeriod
+	}
+	d := &peerDiscovery{
+		c:       c,
+		sources: sources,
+		period:  period,
+		found:   make(map[PeerSource][]string),
+		retries: make(map[string]*greetRetry),
+	}
+	go d.loop()
+}
+
+func (d *peerDiscovery) loop() {
+	var lastLookup time.Time
+	for {
+		if time.Since(lastLookup) >= d.period {
+			d.lookup()
+			lastLookup = time.Now()
+		}
+		d.greetUnknown()
+		time.Sleep(GreetRetryMin)
+	}
+}
+
+func (d *peerDiscovery) lookup() {
+	_, port, err := net.SplitHostPort(d.c.Me.MgmtAddr)
+	if err != nil {
+		log.Printf("ERROR: Discovery: cannot determine own management port: %s", err)
+		return
+	}
+	for _, source := range d.sources {
+		addrs, err := source.Lookup()
+		if err != nil {
+			// keep the previous addresses
+			log.Printf("ERROR: Discovery: cannot look up %s: %s", source, err)
+			continue
+		}
+		resolved := []string{}
+		for _, addr := range addrs {
+			ips, err := resolveAddr(addr, port)
+			if err != nil {
+				log.Printf("WARN: Discovery: cannot resolve `%s` of %s: %s", addr, source, err)
+				continue
+			}
+			resolved = append(resolved, ips...)
+		}
+		d.found[source] = resolved
+	}
+}
+
+// Returns ip:port for every address of the host
+func resolveAddr(addr string, defaultPort string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, defaultPort
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+func (d *peerDiscovery) greetUnknown() {
+	addrs := map[string]bool{}
+	for _, found := range d.found {
+		for _, addr := range found {
+			addrs[addr] = true
+		}
+	}
+
+	// forget addresses which are no longer listed
+	for addr := range d.retries {
+		if !addrs[addr] {
+			delete(d.retries, addr)
+		}
+	}
+
+	now := time.Now()
+	for addr := range addrs {
+		if d.c.KnownMgmtAdr(addr) || d.c.isOwnMgmtAddr(addr) {
+			delete(d.retries, addr)
+			continue
+		}
+		retry, ok := d.retries[addr]
+		if ok && now.Before(retry.next) {
+			continue
+		}
+		if d.c.GreetNode(addr, nil, true) {
+			delete(d.retries, addr)
+			continue
+		}
+		if !ok {
+			retry = &greetRetry{}
+			d.retries[addr] = retry
+		}
+		retry.failures++
+		delay := GreetRetryMin << uint(retry.failures-1)
+		if delay > GreetRetryMax || delay <= 0 {
+			delay = GreetRetryMax
+		}
+		retry.next = now.Add(delay)
+		log.Printf("Discovery: will greet %s again in %s", addr, delay)
+	}
+}
+
+// Returns true if the address is our management interface
+// (seed lists are usually the same on every node, and contain the node itself)
+func (c *Cluster) isOwnMgmtAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	myHost, myPort, err := net.SplitHostPort(c.Me.MgmtAddr)
+	if err != nil || port != myPort {
+		return false
+	}
+	if host == myHost {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range ifaceAddrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,336 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"dftp/dfsfat"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+/*
+* Failure detection (SWIM).
+*
+* Every ProbePeriod a node probes one peer (POST /ping/); peers are probed in turn, in random order.
+* If the peer does not acknowledge the ping within ProbeTimeout, a few other peers are asked to
+* probe it on our behalf (POST /ping-req/). If none of them succeeds either, the peer becomes
+* suspect. A suspect which does not refute the suspicion (see membership.go) within the suspicion
+* timeout is considered dead, and files it owns are hidden from listings. Dead peers are still
+* probed, so they are noticed as soon as they respond again.
+*
+* Pings and acknowledgements carry membership changes (gossip), the sender's clock and free space.
+* Acknowledgements also carry the peer's update epoch and sequence, so updates missed while
+* the peer was unreachable are requested as soon as it responds again.
+*
+* Besides, every MembershipSyncPeriod a node greets a random peer, exchanging the whole lists of
+* nodes, so that changes which have not reached the node by gossip are eventually learned.
+ */
+
+const (
+	ProbePeriod          = 3 * time.Second
+	ProbeTimeout         = 1 * time.Second
+	IndirectProbeTimeout = 2 * time.Second
+	// Number of peers asked to probe a peer which has not acknowledged a ping
+	IndirectProbes = 3
+	// Suspects are declared dead after SuspicionMult * log10(cluster size) probe periods
+	SuspicionMult        = 5
+	MembershipSyncPeriod = 30 * time.Second
+)
+
+// Peer liveness
+const (
+	NodeAlive = iota
+	NodeSuspect
+	NodeDead
+)
+
+var livenessNames = []string{"alive", "suspect", "dead"}
+
+// Body of POST /ping/ and POST /ping-req/
+type Ping struct {
+	Sender MemberState
+	// Node to be probed
+	Target    string
+	Updates   []MemberState
+	Clock     dfsfat.HLCTimestamp
+	FreeSpace int64
+}
+
+// Response to POST /ping/
+type Ack struct {
+	Sender      MemberState
+	Updates     []MemberState
+	UpdateEpoch int64
+	LastSeq     int64
+	Clock       dfsfat.HLCTimestamp
+	FreeSpace   int64
+}
+
+// Response to POST /ping-req/
+type PingReqResult struct {
+	Sender  MemberState
+	Updates []MemberState
+	// The target has acknowledged the ping
+	Acked bool
+}
+
+func (c *Cluster) StartGossip() {
+	// announce a restart to nodes which remember the previous incarnation
+	c.broadcast(c.Me.memberState())
+	go func() {
+		order := []*NodeInfo{}
+		for _ = range time.NewTicker(ProbePeriod).C {
+			c.refreshFreeSpace()
+			c.expireSuspects()
+			if len(order) == 0 {
+				order = c.GetPeers()
+				rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+			}
+			if len(order) == 0 {
+				continue
+			}
+			go c.probe(order[0])
+			order = order[1:]
+		}
+	}()
+	go func() {
+		for _ = range time.NewTicker(MembershipSyncPeriod).C {
+			peers := c.randomPeers(1, "")
+			if len(peers) == 0 {
+				continue
+			}
+			addr := peers[0].memberState().MgmtAddr
+			if err := c.greet(addr, false); err != nil {
+				log.Printf("Error syncing membership with %s (%s): %s", peers[0].Name, addr, err)
+			}
+		}
+	}()
+}
+
+func (c *Cluster) refreshFreeSpace() {
+	freeSpace := c.LocalFs.FreeSpace()
+	c.Me.Lock()
+	c.Me.FreeSpace = freeSpace
+	c.Me.Unlock()
+}
+
+func (n *NodeInfo) GetFreeSpace() int64 {
+	n.Lock()
+	defer n.Unlock()
+	return n.FreeSpace
+}
+
+func (c *Cluster) GetPeers() []*NodeInfo {
+	c.RLock()
+	defer c.RUnlock()
+	peers := make([]*NodeInfo, 0, len(c.Peers))
+	for _, p := range c.Peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Returns up to n random peers which are not dead, except the named one
+func (c *Cluster) randomPeers(n int, except string) []*NodeInfo {
+	candidates := []*NodeInfo{}
+	for _, node := range c.GetPeers() {
+		node.Lock()
+		ok := node.Name != except && node.Liveness != NodeDead
+		node.Unlock()
+		if ok {
+			candidates = append(candidates, node)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+func (c *Cluster) probe(node *NodeInfo) {
+	if c.sendPing(node, ProbeTimeout) {
+		return
+	}
+	state := node.memberState()
+	if state.Liveness == NodeDead {
+		return
+	}
+	helpers := c.randomPeers(IndirectProbes, node.Name)
+	results := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper *NodeInfo) {
+			results <- c.sendPingReq(helper, node)
+		}(helper)
+	}
+	for _ = range helpers {
+		if <-results {
+			return
+		}
+	}
+	if state.Liveness == NodeAlive {
+		state.Liveness = NodeSuspect
+		c.mergeMember(state, fmt.Sprintf("failed probe by %s", c.Me.Name), true)
+	}
+}
+
+func (c *Cluster) makePing(target string) *Ping {
+	return &Ping{
+		Sender:    c.Me.memberState(),
+		Target:    target,
+		Updates:   c.piggyback(),
+		Clock:     c.LocalFs.Clock.Now(),
+		FreeSpace: c.Me.GetFreeSpace(),
+	}
+}
+
+// Pings the node; returns true if it has acknowledged the ping
+func (c *Cluster) sendPing(node *NodeInfo, timeout time.Duration) bool {
+	target := node.memberState()
+	ping := c.makePing(node.Name)
+	if target.Liveness != NodeAlive {
+		// let the node refute the suspicion right away
+		ping.Updates = append(ping.Updates, target)
+	}
+	ack := &Ack{}
+	if err := c.postGossip(target.MgmtAddr, "/ping/", ping, ack, timeout); err != nil {
+		return false
+	}
+	if ack.Sender.Name != node.Name {
+		log.Printf("WARN: %s acknowledged a ping to %s", ack.Sender.Name, node.Name)
+		return false
+	}
+	c.receiveGossip(ack.Sender, ack.Updates, target.MgmtAddr)
+	c.LocalFs.Clock.Observe(ack.Clock)
+	c.MarkAlive(node)
+
+	node.Lock()
+	node.FreeSpace = ack.FreeSpace
+	missedUpdates := !node.pulling && (ack.UpdateEpoch != node.LastUpdateReceivedEpoch || ack.LastSeq > node.LastUpdateReceivedSeq)
+	if missedUpdates {
+		node.pulling = true
+	}
+	// a push has failed (e.g. the node did not know us yet)
+	pushFailed := node.PushState == StateNever
+	node.Unlock()
+	if missedUpdates {
+		go func() {
+			c.PullUpdate(node)
+			node.Lock()
+			node.pulling = false
+			node.Unlock()
+		}()
+	}
+	if pushFailed && c.LocalFs.IsScanned() {
+		c.SchedulePush(node)
+	}
+	return true
+}
+
+// Asks `helper` to ping `node`; returns true if the node has acknowledged the ping
+func (c *Cluster) sendPingReq(helper *NodeInfo, node *NodeInfo) bool {
+	addr := helper.memberState().MgmtAddr
+	res := &PingReqResult{}
+	if err := c.postGossip(addr, "/ping-req/", c.makePing(node.Name), res, IndirectProbeTimeout); err != nil {
+		return false
+	}
+	if res.Sender.Name != helper.Name {
+		return false
+	}
+	c.receiveGossip(res.Sender, res.Updates, addr)
+	c.MarkAlive(helper)
+	return res.Acked
+}
+
+// Merges membership information received from `sender` at `remoteAddr`
+func (c *Cluster) receiveGossip(sender MemberState, updates []MemberState, remoteAddr string) {
+	// nodes may not know their own host
+	fixAddrs := func(state *MemberState) {
+		state.MgmtAddr = combineHostAndPort(remoteAddr, state.MgmtAddr)
+		state.PublicAddr = combineHostAndPort(remoteAddr, state.PublicAddr)
+	}
+	fixAddrs(&sender)
+	c.mergeMember(sender, sender.Name, true)
+	for _, state := range updates {
+		if state.Name == sender.Name {
+			fixAddrs(&state)
+		}
+		c.mergeMember(state, sender.Name, true)
+	}
+}
+
+// Handles a ping or ping request; returns the sender
+func (c *Cluster) receivePing(ping *Ping, remoteAddr string) (*NodeInfo, bool) {
+	c.receiveGossip(ping.Sender, ping.Updates, remoteAddr)
+	c.LocalFs.Clock.Observe(ping.Clock)
+	c.RLock()
+	node, ok := c.Peers[ping.Sender.Name]
+	c.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	c.MarkAlive(node)
+	node.Lock()
+	node.FreeSpace = ping.FreeSpace
+	node.Unlock()
+	return node, true
+}
+
+func (c *Cluster) postGossip(addr string, path string, request interface{}, response interface{}, timeout time.Duration) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(request); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r, body, err := c.mgmtRequestContext(ctx, "POST", addr, path, "application/json", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %d (%s)", r.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, response)
+}
+
+// Called whenever we hear from the node. Liveness is decided by probes and gossip only.
+func (c *Cluster) MarkAlive(node *NodeInfo) {
+	node.Lock()
+	defer node.Unlock()
+	node.LastAlive = time.Now().Unix()
+}
+
+// Returns false if the node is known to be dead
+func (c *Cluster) IsNodeAvailable(name string) bool {
+	c.RLock()
+	node, ok := c.Peers[name]
+	c.RUnlock()
+	if !ok {
+		// this node, several nodes or a node we know nothing about
+		return true
+	}
+	node.Lock()
+	defer node.Unlock()
+	return node.Liveness != NodeDead
+}
+
+// Returns true if the entry should be displayed in listings:
+// it is not deleted, and at least one of its owners is available.
+func (c *Cluster) IsVisible(stat *dfsfat.FileStat) bool {
+	if stat.IsDeleted() {
+		return false
+	}
+	if len(stat.Owners) == 0 {
+		return c.IsNodeAvailable(stat.OwnerNode)
+	}
+	for _, owner := range stat.Owners {
+		if c.IsNodeAvailable(owner) {
+			return true
+		}
+	}
+	return false
+}
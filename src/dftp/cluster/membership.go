@@ -0,0 +1,216 @@
+package cluster
+
+/*
+* Cluster membership.
+*
+* Every node has an incarnation number, which only the node itself increases. Information
+* about a node (alive, suspect or dead) is tagged with its incarnation; of two pieces of
+* information, the one with the greater incarnation wins, and at the same incarnation
+* `suspect` overrides `alive`, and `dead` overrides both. A node which learns it is suspected
+* (or declared dead) refutes that by increasing its incarnation and announcing itself alive.
+* Incarnations start at the startup time, so a restarted node overrides whatever the cluster
+* has heard about its previous run.
+*
+* Changes of membership are disseminated by gossip: every change a node learns of is
+* piggybacked on the next few probe messages it sends or answers (see gossip.go), a limited
+* number of times which grows logarithmically with the cluster size.
+ */
+
+import (
+	"dftp/utils"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Every membership change is piggybacked RetransmitMult * log10(cluster size) times
+	RetransmitMult = 4
+	// Maximum number of membership changes piggybacked on a single message
+	MaxPiggybacked = 10
+)
+
+// Information about a node spread by gossip
+type MemberState struct {
+	Name          string
+	PublicAddr    string
+	MgmtAddr      string
+	DfsMountPoint string
+	Incarnation   int64
+	Liveness      int
+}
+
+type gossipBroadcast struct {
+	state     MemberState
+	transmits int
+}
+
+// Membership changes waiting to be piggybacked
+type gossipQueue struct {
+	sync.Mutex
+	// node name -> latest change
+	broadcasts map[string]*gossipBroadcast
+}
+
+func newGossipQueue() *gossipQueue {
+	return &gossipQueue{broadcasts: make(map[string]*gossipBroadcast)}
+}
+
+func (n *NodeInfo) memberState() MemberState {
+	n.Lock()
+	defer n.Unlock()
+	return MemberState{
+		Name:          n.Name,
+		PublicAddr:    n.PublicAddr,
+		MgmtAddr:      n.MgmtAddr,
+		DfsMountPoint: n.DfsMountPoint,
+		Incarnation:   n.Incarnation,
+		Liveness:      n.Liveness,
+	}
+}
+
+// Queues the change to be piggybacked, replacing older changes of the same node
+func (c *Cluster) broadcast(state MemberState) {
+	c.gossip.Lock()
+	c.gossip.broadcasts[state.Name] = &gossipBroadcast{state: state}
+	c.gossip.Unlock()
+}
+
+// Returns membership changes to piggyback on a message
+func (c *Cluster) piggyback() []MemberState {
+	c.RLock()
+	limit := RetransmitMult * int(math.Ceil(math.Log10(float64(len(c.Peers)+2))))
+	c.RUnlock()
+
+	c.gossip.Lock()
+	defer c.gossip.Unlock()
+	queued := make([]*gossipBroadcast, 0, len(c.gossip.broadcasts))
+	for _, b := range c.gossip.broadcasts {
+		queued = append(queued, b)
+	}
+	// least transmitted first
+	utils.SortSlice(queued, func(l, r interface{}) bool {
+		return l.(*gossipBroadcast).transmits < r.(*gossipBroadcast).transmits
+	})
+	states := []MemberState{}
+	for _, b := range queued {
+		if len(states) == MaxPiggybacked {
+			break
+		}
+		states = append(states, b.state)
+		b.transmits++
+		if b.transmits >= limit {
+			delete(c.gossip.broadcasts, b.state.Name)
+		}
+	}
+	return states
+}
+
+// Merges information about a node, received from `origin` (for logging).
+// The node is added if it is unknown. Changes are spread further if `spread` is set.
+func (c *Cluster) mergeMember(state MemberState, origin string, spread bool) {
+	if state.Name == "" {
+		return
+	}
+	if state.Name == c.Me.Name {
+		c.refute(state, origin)
+		return
+	}
+
+	c.Lock()
+	node, known := c.Peers[state.Name]
+	if !known {
+		if state.Liveness == NodeDead {
+			// nothing to learn about a node we have never seen
+			c.Unlock()
+			return
+		}
+		log.Printf("Met new node: %s (from %s)", state.Name, origin)
+		node = &NodeInfo{
+			Name:          state.Name,
+			PublicAddr:    state.PublicAddr,
+			MgmtAddr:      state.MgmtAddr,
+			DfsMountPoint: state.DfsMountPoint,
+			Incarnation:   state.Incarnation,
+			Liveness:      state.Liveness,
+			LastAlive:     time.Now().Unix(),
+			FreeSpace:     -1,
+		}
+		if state.Liveness == NodeSuspect {
+			node.suspectSince = time.Now()
+		}
+		c.Peers[state.Name] = node
+		c.Unlock()
+		if spread {
+			c.broadcast(state)
+		}
+		c.SchedulePush(node)
+		return
+	}
+	c.Unlock()
+
+	node.Lock()
+	newer := state.Incarnation > node.Incarnation
+	worse := state.Incarnation == node.Incarnation && state.Liveness > node.Liveness
+	if !newer && !worse {
+		node.Unlock()
+		return
+	}
+	if newer {
+		node.PublicAddr = state.PublicAddr
+		node.MgmtAddr = state.MgmtAddr
+		node.DfsMountPoint = state.DfsMountPoint
+		node.Incarnation = state.Incarnation
+	}
+	if state.Liveness != node.Liveness {
+		log.Printf("Peer %s is %s (incarnation %d, from %s)", node.Name, livenessNames[state.Liveness], state.Incarnation, origin)
+		if state.Liveness == NodeSuspect {
+			node.suspectSince = time.Now()
+		}
+		node.Liveness = state.Liveness
+	}
+	node.Unlock()
+	if spread {
+		c.broadcast(state)
+	}
+}
+
+// Handles information about this node: if others suspect us or consider us dead,
+// announces that we are alive with a greater incarnation
+func (c *Cluster) refute(state MemberState, origin string) {
+	c.Me.Lock()
+	if state.Liveness == NodeAlive || state.Incarnation < c.Me.Incarnation {
+		c.Me.Unlock()
+		return
+	}
+	c.Me.Incarnation = state.Incarnation + 1
+	log.Printf("Refuting that we are %s (from %s), incarnation is now %d", livenessNames[state.Liveness], origin, c.Me.Incarnation)
+	c.Me.Unlock()
+	c.broadcast(c.Me.memberState())
+}
+
+// Declares suspects which have not refuted the suspicion in time dead
+func (c *Cluster) expireSuspects() {
+	c.RLock()
+	n := len(c.Peers) + 1
+	c.RUnlock()
+	timeout := suspicionTimeout(n)
+	now := time.Now()
+	for _, node := range c.GetPeers() {
+		node.Lock()
+		expired := node.Liveness == NodeSuspect && now.Sub(node.suspectSince) > timeout
+		node.Unlock()
+		if expired {
+			state := node.memberState()
+			state.Liveness = NodeDead
+			c.mergeMember(state, "suspicion timeout", true)
+		}
+	}
+}
+
+// Time a suspect is given to refute the suspicion; grows logarithmically with the cluster size
+func suspicionTimeout(clusterSize int) time.Duration {
+	scale := math.Max(1, math.Log10(float64(clusterSize)))
+	return time.Duration(SuspicionMult * scale * float64(ProbePeriod))
+}
@@ -1,11 +1,17 @@
 package cluster
 
 import (
+	"dftp/auth"
 	"dftp/httputils"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 /*
@@ -15,11 +21,30 @@ import (
 func (c *Cluster) ServeHttp(addr string) {
 	c.mux = http.NewServeMux()
 	httputils.HandleFunc(c.mux, "/", c.HttpIndex)
-	httputils.HandleFunc(c.mux, "/cluster/", c.HttpCluster)
+	httputils.HandleFunc(c.mux, "/cluster/", c.signedHandler(c.HttpCluster, "GET"))
 	httputils.HandleFunc(c.mux, "/join/", c.HttpJoin)
-	httputils.HandleFunc(c.mux, "/update/", c.HttpUpdate)
-	log.Printf("HTTP mgmt interface listening on %s...", addr)
-	if err := http.ListenAndServe(addr, c.mux); err != nil {
+	httputils.HandleFunc(c.mux, "/update/", c.signedHandler(c.HttpUpdate))
+	httputils.HandleFunc(c.mux, "/updates/", c.signedHandler(c.HttpUpdates))
+	httputils.HandleFunc(c.mux, "/ping/", c.signedHandler(c.HttpPing))
+	httputils.HandleFunc(c.mux, "/ping-req/", c.signedHandler(c.HttpPingReq))
+	httputils.HandleFunc(c.mux, "/merkle/", c.signedHandler(c.HttpMerkle))
+	httputils.HandleFunc(c.mux, "/conflicts/", c.HttpConflicts)
+	httputils.HandleFunc(c.mux, "/cache/", c.HttpCache)
+	httputils.HandleFunc(c.mux, "/sign/", c.HttpSign)
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   c.mux,
+		TLSConfig: c.mgmtTLSConfig(),
+	}
+	var err error
+	if server.TLSConfig != nil {
+		log.Printf("HTTP mgmt interface listening on %s (mutual TLS)...", addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("HTTP mgmt interface listening on %s...", addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatalf("http: %s", err)
 	}
 }
@@ -28,6 +53,9 @@ func (c *Cluster) HttpIndex(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, `Hi!
 		* GET /cluster/  to list peers
 		* POST /join/?peer=ip:port  to initiate cluster membership
+		* GET /conflicts/  to list files with conflicting replicas
+		* GET /cache/  to get remote file cache statistics
+		* POST /sign/?path=/dir/file&user=login&ttl=1h  to make a signed download link
 	`, 404)
 }
 
@@ -40,20 +68,33 @@ func (c *Cluster) HttpCluster(w http.ResponseWriter, r *http.Request) {
 		info.Name = r.FormValue("name")
 		info.PublicAddr = r.FormValue("public-addr")
 		info.MgmtAddr = r.FormValue("mgmt-addr")
+		info.DfsMountPoint = r.FormValue("dfs-mount")
 		if info.Name == "" || info.PublicAddr == "" || info.MgmtAddr == "" {
 			http.Error(w, "name, public-addr and mgmt-addr are required parameters", http.StatusBadRequest)
 			return
 		}
+		if !checkSender(w, r, info.Name) {
+			return
+		}
+		if clusterName := r.FormValue("cluster-name"); clusterName != c.Name {
+			log.Printf("WARN: rejected greeting of `%s` from %s: it belongs to cluster `%s`, not `%s`", info.Name, r.RemoteAddr, clusterName, c.Name)
+			http.Error(w, fmt.Sprintf("this node belongs to cluster `%s`", c.Name), http.StatusForbidden)
+			return
+		}
 		// TODO: validation: PublicAddr, MgmtAddr must be in form <host>:<port> or :<port>
 		info.PublicAddr = combineHostAndPort(r.RemoteAddr, info.PublicAddr)
 		info.MgmtAddr = combineHostAndPort(r.RemoteAddr, info.MgmtAddr)
-		c.UpdateNode(info)
-		if r.FormValue("request-full-update") == "true" {
-			c.RLock()
-			node, ok := c.Peers[info.Name]
-			c.RUnlock()
-			if ok {
-				c.SchedulePush(node)
+		info.Incarnation, _ = strconv.ParseInt(r.FormValue("incarnation"), 10, 64)
+		c.observeClock(r.FormValue("clock"))
+		// spread the news about the node to the rest of the cluster
+		c.mergeMember(info.memberState(), info.Name, true)
+		c.RLock()
+		node, ok := c.Peers[info.Name]
+		c.RUnlock()
+		if ok {
+			c.MarkAlive(node)
+			if r.FormValue("request-full-update") == "true" {
+				c.ScheduleFullPush(node)
 			}
 		}
 	}
@@ -63,19 +104,26 @@ func (c *Cluster) HttpCluster(w http.ResponseWriter, r *http.Request) {
 func (c *Cluster) httpClusterInfoResponse(w http.ResponseWriter, r *http.Request) {
 	c.RLock()
 	defer c.RUnlock()
+	info := c.PublicClusterInfo
+	info.Clock = c.LocalFs.Clock.Now()
 	enc := json.NewEncoder(w)
-	err := enc.Encode(c.PublicClusterInfo)
+	err := enc.Encode(info)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 	}
 }
 
-// POST /join/: initiate joining a cluster
+// POST /join/: initiate joining a cluster. Allowed only from this host, unless mutual TLS is enabled.
 func (c *Cluster) HttpJoin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, `Use POST /join/?peer=ip:port`, http.StatusMethodNotAllowed)
 		return
 	}
+	if !c.isAdminRequest(r) {
+		log.Printf("WARN: rejected %s %s from %s: not an administrator", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "joins can be requested only from this host, or with a client certificate of the cluster CA", http.StatusForbidden)
+		return
+	}
 	r.ParseForm()
 	if len(r.Form["peer"]) == 0 {
 		http.Error(w, `Specify at least one 'peer'`, http.StatusBadRequest)
@@ -104,6 +152,232 @@ func (c *Cluster) HttpUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf(`Error decoding json: %s`, err), http.StatusBadRequest)
 		return
 	}
-	go c.ReceiveUpdate(&upd)
+	if !checkSender(w, r, upd.SenderNodeName) {
+		return
+	}
+	c.RLock()
+	node, known := c.Peers[upd.SenderNodeName]
+	c.RUnlock()
+	if !known {
+		// the sender will push again once we have learned about it
+		http.Error(w, fmt.Sprintf("unknown node `%s`, greet first", upd.SenderNodeName), http.StatusConflict)
+		return
+	}
+	c.queueUpdate(node, &upd)
 	http.Error(w, "ok", http.StatusOK)
 }
+
+// GET /updates/?epoch=E&since=N: get every change made after sequence N of epoch E.
+// Responds with a full update if the changes cannot be provided incrementally.
+func (c *Cluster) HttpUpdates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, `Use GET /updates/?epoch=E&since=N`, http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.LocalFs.IsScanned() {
+		http.Error(w, `Local scan is in progress, try again later`, http.StatusServiceUnavailable)
+		return
+	}
+	epoch, err := strconv.ParseInt(r.FormValue("epoch"), 10, 64)
+	if err != nil {
+		epoch = 0
+	}
+	since, err := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	if err != nil {
+		since = -1
+	}
+	upd := c.makeUpdate(since, epoch != c.UpdateLog.Epoch)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(upd)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// POST /ping/: probe the node (see gossip.go)
+func (c *Cluster) HttpPing(w http.ResponseWriter, r *http.Request) {
+	ping, ok := c.decodePing(w, r)
+	if !ok {
+		return
+	}
+	if ping.Target != c.Me.Name {
+		// the address belongs to another node now
+		http.Error(w, fmt.Sprintf("this is node `%s`, not `%s`", c.Me.Name, ping.Target), http.StatusConflict)
+		return
+	}
+	node, _ := c.receivePing(ping, r.RemoteAddr)
+
+	ack := &Ack{
+		Sender:      c.Me.memberState(),
+		Updates:     c.piggyback(),
+		UpdateEpoch: c.UpdateLog.Epoch,
+		LastSeq:     c.UpdateLog.LastSeq(),
+		Clock:       c.LocalFs.Clock.Now(),
+		FreeSpace:   c.Me.GetFreeSpace(),
+	}
+	if node != nil {
+		if state := node.memberState(); state.Liveness != NodeAlive {
+			// let the sender refute the suspicion right away
+			ack.Updates = append(ack.Updates, state)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ack)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// POST /ping-req/: probe the target node on behalf of the sender (see gossip.go)
+func (c *Cluster) HttpPingReq(w http.ResponseWriter, r *http.Request) {
+	ping, ok := c.decodePing(w, r)
+	if !ok {
+		return
+	}
+	c.receivePing(ping, r.RemoteAddr)
+	c.RLock()
+	target, ok := c.Peers[ping.Target]
+	c.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown node `%s`", ping.Target), http.StatusNotFound)
+		return
+	}
+
+	res := &PingReqResult{
+		Acked: c.sendPing(target, ProbeTimeout),
+	}
+	res.Sender = c.Me.memberState()
+	res.Updates = c.piggyback()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (c *Cluster) decodePing(w http.ResponseWriter, r *http.Request) (*Ping, bool) {
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf(`Use POST %s`, r.URL.Path), http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	ping := &Ping{}
+	if err := json.NewDecoder(r.Body).Decode(ping); err != nil {
+		http.Error(w, fmt.Sprintf(`Error decoding json: %s`, err), http.StatusBadRequest)
+		return nil, false
+	}
+	if ping.Sender.Name == "" || ping.Sender.Name == c.Me.Name {
+		http.Error(w, "invalid sender", http.StatusBadRequest)
+		return nil, false
+	}
+	if !checkSender(w, r, ping.Sender.Name) {
+		return nil, false
+	}
+	return ping, true
+}
+
+// GET /merkle/?path=/dir&export=true: hashes of the entry and of its children, compared by peers
+// during anti-entropy (see antientropy.go). With `export`, also every replica inside the entry;
+// if there are more than AntiEntropyMaxExport of them, only the replicas of its children, if not too many either.
+func (c *Cluster) HttpMerkle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, `Use GET /merkle/?path=/dir`, http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(filepath.Clean("/"+r.FormValue("path")), "/")
+	entry := c.DfsRoot.Seek(path)
+	if entry == nil {
+		http.Error(w, fmt.Sprintf("no such entry: /%s", path), http.StatusNotFound)
+		return
+	}
+	res := &MerkleEntry{EntryHashes: *entry.GetHashes()}
+	if r.FormValue("export") == "true" {
+		files, ok := entry.ExportEntry(path, AntiEntropyMaxExport)
+		if !ok {
+			files = c.exportChildren(path, res.Children, AntiEntropyMaxExport)
+		}
+		res.Files = files
+		res.TooLarge = !ok
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// GET /conflicts/: list files whose replicas on different nodes differ
+func (c *Cluster) HttpConflicts(w http.ResponseWriter, r *http.Request) {
+	conflicts := c.DfsRoot.FindConflicts()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(conflicts)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// GET /cache/: statistics of the remote file cache
+func (c *Cluster) HttpCache(w http.ResponseWriter, r *http.Request) {
+	if c.Proxy.Cache == nil {
+		http.Error(w, "cache is disabled", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(c.Proxy.Cache.GetStats())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+type SignedUrl struct {
+	// Path and query of the link on the public HTTP interface of any node
+	Url     string
+	Expires int64
+}
+
+// POST /sign/: make a signed link to download `path` on behalf of `user` (anonymous by default),
+// valid for `ttl` (1h by default). Only clients with a certificate of the cluster CA may do that.
+func (c *Cluster) HttpSign(w http.ResponseWriter, r *http.Request) {
+	if c.UrlSigner == nil {
+		http.Error(w, "URL signing is disabled", 404)
+		return
+	}
+	if c.tls == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		log.Printf("WARN: rejected %s %s from %s: no client certificate", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "a client certificate of the cluster CA is required", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, `Use POST /sign/?path=/dir/file&user=login&ttl=1h`, http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(filepath.Clean("/"+r.FormValue("path")), "/")
+	user := r.FormValue("user")
+	if user == "" {
+		user = auth.AnonymousUser
+	}
+	ttl := auth.DefaultSignedUrlTTL
+	if s := r.FormValue("ttl"); s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl `%s`", s), http.StatusBadRequest)
+			return
+		}
+	}
+	expires := time.Now().Add(ttl)
+	link := &url.URL{
+		Path:     "/fs/" + path,
+		RawQuery: c.UrlSigner.Sign(path, user, expires).Encode(),
+	}
+	log.Printf("Signed link to /%s for `%s`, valid until %s", path, user, expires.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(&SignedUrl{Url: link.String(), Expires: expires.Unix()})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
@@ -0,0 +1,39 @@
+package cluster
+
+import (
+	"net"
+	"syscall"
+)
+
+const multicastOptionsSupported = true
+
+// Sets the outgoing interface (unless nil) and time-to-live of multicast datagrams sent by the socket
+func setMulticastOptions(conn *net.UDPConn, ifi *net.Interface, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv6 := conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			if ifi != nil {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+			}
+			if sockErr == nil {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+			}
+			return
+		}
+		if ifi != nil {
+			sockErr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(ifi.Index)})
+		}
+		if sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
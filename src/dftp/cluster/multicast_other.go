@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package cluster
+
+import (
+	"net"
+)
+
+const multicastOptionsSupported = false
+
+func setMulticastOptions(conn *net.UDPConn, ifi *net.Interface, ttl int) error {
+	return MulticastOptionsNotSupportedError
+}
@@ -3,6 +3,7 @@ package cluster
 import (
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"time"
@@ -12,13 +13,24 @@ import (
 * Multicast peer discovery.
 *
 * Every node periodically transmits information about its cluster name and management address.
-* Once a node receives information anout previously-unknown peer, it initiates greeting procedure via HTTP.
+* Once a node receives information anout previously-unknown peer of the same cluster, it initiates
+* greeting procedure via HTTP. Pings of other clusters are ignored.
+*
+* Sockets are opened anew after errors, so discovery survives e.g. network interfaces going down.
 *
 * Multicast is used only for discovery.
  */
 
 const (
 	DiscoveryPingPeriod = 55 * time.Second
+	// Delay before opening a multicast socket again after an error
+	DiscoveryRestartDelay = 5 * time.Second
+	// Names of at most that many other clusters are remembered (and logged once each)
+	maxForeignClusters = 64
+)
+
+var (
+	MulticastOptionsNotSupportedError = fmt.Errorf("multicast interface and TTL cannot be set on this platform")
 )
 
 type DiscoveryPing struct {
@@ -26,72 +38,170 @@ type DiscoveryPing struct {
 	ClusterName string
 	NodeName    string
 	MgmtAddr    string
+	// Unix time in milliseconds and signature, if the cluster secret is set
+	Time      int64  `json:",omitempty"`
+	Signature string `json:",omitempty"`
 }
 
-func (c *Cluster) StartMulticastDiscovery(mcastAddrStr string) {
-	mcaddr, err := net.ResolveUDPAddr("udp", mcastAddrStr)
-	if err != nil {
-		log.Fatalf("ERROR: %s", err)
-	}
+type MulticastOptions struct {
+	// ip:port of the multicast group
+	Addr string
+	// Name of the network interface to use; empty for the system default
+	Interface string
+	// Time-to-live of the pings (1 keeps them within the local network)
+	TTL        int
+	PingPeriod time.Duration
+}
 
-	conn, err := net.ListenMulticastUDP("udp", nil, mcaddr)
+type multicastDiscovery struct {
+	c     *Cluster
+	opts  MulticastOptions
+	group *net.UDPAddr
+	ifi   *net.Interface
+	// clusters whose pings have been ignored (logged once, up to maxForeignClusters)
+	foreignClusters map[string]bool
+}
+
+// Starts multicast discovery; returns an error if the options are invalid.
+// Socket errors are logged, and sockets are opened again after DiscoveryRestartDelay.
+func (c *Cluster) StartMulticastDiscovery(opts MulticastOptions) error {
+	group, err := net.ResolveUDPAddr("udp", opts.Addr)
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		return err
 	}
-
-	listen := func() {
-		for {
-			b := make([]byte, 1024)
-			n, clientAddr, err := conn.ReadFromUDP(b)
-			if err != nil {
-				log.Fatalf("ReadFromUDP: %s", err)
-			}
-			b = b[:n]
-			ping := &DiscoveryPing{}
-			err = json.Unmarshal(b, ping)
-			if err != nil {
-				log.Printf("WARN: cannot unmarshal multicast message from %v: %s: `%s`", clientAddr, err, hex.EncodeToString(b))
-				continue
-			}
-			if ping.Type == "ping" && ping.MgmtAddr != "" && ping.NodeName != c.Me.Name {
-				ping.MgmtAddr = combineHostAndPort(clientAddr.String(), ping.MgmtAddr)
-				if !c.KnownMgmtAdr(ping.MgmtAddr) {
-					log.Printf("INFO: multicast discovered new peer: %v", ping)
-					c.GreetNode(ping.MgmtAddr, nil, true)
-				}
-			}
+	if !group.IP.IsMulticast() {
+		return fmt.Errorf("%s is not a multicast address", opts.Addr)
+	}
+	if opts.PingPeriod <= 0 {
+		opts.PingPeriod = DiscoveryPingPeriod
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 1
+	}
+	if (opts.Interface != "" || opts.TTL != 1) && !multicastOptionsSupported {
+		return MulticastOptionsNotSupportedError
+	}
+	d := &multicastDiscovery{
+		c:               c,
+		opts:            opts,
+		group:           group,
+		foreignClusters: make(map[string]bool),
+	}
+	if opts.Interface != "" {
+		d.ifi, err = net.InterfaceByName(opts.Interface)
+		if err != nil {
+			return err
 		}
 	}
+	go d.listenLoop()
+	go d.pingLoop()
+	return nil
+}
 
-	ping := func(socket net.Conn) {
-		ping := &DiscoveryPing{
-			Type:        "ping",
-			ClusterName: c.Name,
-			NodeName:    c.Me.Name,
-			MgmtAddr:    c.Me.MgmtAddr,
+func (d *multicastDiscovery) listenLoop() {
+	for {
+		conn, err := net.ListenMulticastUDP("udp", d.ifi, d.group)
+		if err != nil {
+			log.Printf("ERROR: cannot listen for multicast pings on %s, retrying in %s: %s", d.opts.Addr, DiscoveryRestartDelay, err)
+			time.Sleep(DiscoveryRestartDelay)
+			continue
 		}
-		jsonPing, err := json.Marshal(ping)
+		err = d.listen(conn)
+		conn.Close()
+		log.Printf("ERROR: receiving multicast pings, reopening socket in %s: %s", DiscoveryRestartDelay, err)
+		time.Sleep(DiscoveryRestartDelay)
+	}
+}
+
+// Receives pings until a socket error occurs
+func (d *multicastDiscovery) listen(conn *net.UDPConn) error {
+	c := d.c
+	for {
+		b := make([]byte, 1024)
+		n, clientAddr, err := conn.ReadFromUDP(b)
 		if err != nil {
-			log.Fatalf("cannot serialize ping: %s", err)
+			return err
 		}
-		_, err = socket.Write(jsonPing)
+		b = b[:n]
+		ping := &DiscoveryPing{}
+		err = json.Unmarshal(b, ping)
 		if err != nil {
-			log.Printf("ERROR: sending multicast ping: %s", err)
+			log.Printf("WARN: cannot unmarshal multicast message from %v: %s: `%s`", clientAddr, err, hex.EncodeToString(b))
+			continue
+		}
+		if ping.Type != "ping" || ping.MgmtAddr == "" || ping.NodeName == c.Me.Name {
+			continue
+		}
+		if ping.ClusterName != c.Name {
+			if !d.foreignClusters[ping.ClusterName] && len(d.foreignClusters) < maxForeignClusters {
+				d.foreignClusters[ping.ClusterName] = true
+				log.Printf("INFO: ignoring multicast pings of cluster `%s` (first seen from node `%s` at %v)", ping.ClusterName, ping.NodeName, clientAddr)
+				if len(d.foreignClusters) == maxForeignClusters {
+					log.Printf("WARN: pings of %d other clusters seen, pings of further clusters are ignored silently", maxForeignClusters)
+				}
+			}
+			continue
+		}
+		if err := c.verifyPing(ping); err != nil {
+			log.Printf("WARN: rejected multicast ping of `%s` from %v: %s", ping.NodeName, clientAddr, err)
+			continue
+		}
+		ping.MgmtAddr = combineHostAndPort(clientAddr.String(), ping.MgmtAddr)
+		if !c.KnownMgmtAdr(ping.MgmtAddr) {
+			log.Printf("INFO: multicast discovered new peer: %v", ping)
+			c.GreetNode(ping.MgmtAddr, nil, true)
 		}
 	}
+}
 
-	pingloop := func() {
-		socket, err := net.DialUDP("udp", nil, mcaddr)
+func (d *multicastDiscovery) pingLoop() {
+	ticker := time.NewTicker(d.opts.PingPeriod)
+	for {
+		socket, err := d.dial()
 		if err != nil {
-			log.Fatalf("DialUDP: %s", err)
+			log.Printf("ERROR: cannot open socket for multicast pings to %s, retrying in %s: %s", d.opts.Addr, DiscoveryRestartDelay, err)
+			time.Sleep(DiscoveryRestartDelay)
+			continue
 		}
-		ping(socket)
+		for err == nil {
+			err = d.ping(socket)
+			if err == nil {
+				<-ticker.C
+			}
+		}
+		socket.Close()
+		log.Printf("ERROR: sending multicast ping, reopening socket in %s: %s", DiscoveryRestartDelay, err)
+		time.Sleep(DiscoveryRestartDelay)
+	}
+}
 
-		for _ = range time.NewTicker(DiscoveryPingPeriod).C {
-			ping(socket)
+func (d *multicastDiscovery) dial() (*net.UDPConn, error) {
+	socket, err := net.DialUDP("udp", nil, d.group)
+	if err != nil {
+		return nil, err
+	}
+	if d.ifi != nil || d.opts.TTL != 1 {
+		if err := setMulticastOptions(socket, d.ifi, d.opts.TTL); err != nil {
+			socket.Close()
+			return nil, err
 		}
 	}
+	return socket, nil
+}
 
-	go listen()
-	go pingloop()
+func (d *multicastDiscovery) ping(socket *net.UDPConn) error {
+	c := d.c
+	ping := &DiscoveryPing{
+		Type:        "ping",
+		ClusterName: c.Name,
+		NodeName:    c.Me.Name,
+		MgmtAddr:    c.Me.MgmtAddr,
+	}
+	c.signPing(ping)
+	jsonPing, err := json.Marshal(ping)
+	if err != nil {
+		log.Fatalf("cannot serialize ping: %s", err)
+	}
+	_, err = socket.Write(jsonPing)
+	return err
 }
@@ -0,0 +1,166 @@
+package cluster
+
+/*
+* Placement of new files and directories.
+*
+* A new entry can be created only on a node whose local tree is mounted above it
+* (see --dfsmount), and which is available. Placement policy chooses one of such nodes.
+ */
+
+import (
+	"dftp/utils"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync/atomic"
+)
+
+type PlacementPolicy interface {
+	// Chooses one of the candidates (never empty) to create the path on
+	Place(c *Cluster, path string, candidates []*NodeInfo) *NodeInfo
+}
+
+// Prefers the nodes owning the closest existing directory on the path (this node first);
+// if none of them can store the path, prefers this node, then the node with most free space.
+type parentOwnerPlacement struct{}
+
+func (p parentOwnerPlacement) Place(c *Cluster, path string, candidates []*NodeInfo) *NodeInfo {
+	byName := make(map[string]*NodeInfo, len(candidates))
+	for _, node := range candidates {
+		byName[node.Name] = node
+	}
+	for dir := path; ; dir = parentPath(dir) {
+		entry := c.DfsRoot.Seek(dir)
+		if entry != nil {
+			ro := entry.GetReadonly()
+			if dir == "" || c.IsVisible(&ro.FileStat) {
+				owners := ownersOf(&ro.FileStat)
+				for _, owner := range owners {
+					if owner == c.Me.Name && byName[owner] != nil {
+						return byName[owner]
+					}
+				}
+				if node, ok := byName[ro.OwnerNode]; ok {
+					return node
+				}
+				for _, owner := range owners {
+					if node, ok := byName[owner]; ok {
+						return node
+					}
+				}
+			}
+		}
+		if dir == "" {
+			break
+		}
+	}
+	if node, ok := byName[c.Me.Name]; ok {
+		return node
+	}
+	return freeSpacePlacement{}.Place(c, path, candidates)
+}
+
+// Prefers the node with most free space
+type freeSpacePlacement struct{}
+
+func (p freeSpacePlacement) Place(c *Cluster, path string, candidates []*NodeInfo) *NodeInfo {
+	var best *NodeInfo
+	var bestSpace int64
+	for _, node := range candidates {
+		space := node.GetFreeSpace()
+		if best == nil || space > bestSpace {
+			best = node
+			bestSpace = space
+		}
+	}
+	return best
+}
+
+// Takes the candidates in turn
+type roundRobinPlacement struct {
+	counter *uint64
+}
+
+func (p roundRobinPlacement) Place(c *Cluster, path string, candidates []*NodeInfo) *NodeInfo {
+	i := atomic.AddUint64(p.counter, 1)
+	return candidates[i%uint64(len(candidates))]
+}
+
+// Rendezvous hashing of the path: the same path always goes to the same node,
+// and only paths of the joining or leaving node move when the set of nodes changes
+type hashPlacement struct{}
+
+func (p hashPlacement) Place(c *Cluster, path string, candidates []*NodeInfo) *NodeInfo {
+	var best *NodeInfo
+	var bestWeight uint64
+	for _, node := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(node.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(path))
+		weight := h.Sum64()
+		if best == nil || weight > bestWeight {
+			best = node
+			bestWeight = weight
+		}
+	}
+	return best
+}
+
+var (
+	ParentOwnerPlacement PlacementPolicy = parentOwnerPlacement{}
+	FreeSpacePlacement   PlacementPolicy = freeSpacePlacement{}
+	RoundRobinPlacement  PlacementPolicy = roundRobinPlacement{counter: new(uint64)}
+	HashPlacement        PlacementPolicy = hashPlacement{}
+)
+
+func PlacementPolicyByName(name string) (PlacementPolicy, error) {
+	switch name {
+	case "parent":
+		return ParentOwnerPlacement, nil
+	case "free-space":
+		return FreeSpacePlacement, nil
+	case "round-robin":
+		return RoundRobinPlacement, nil
+	case "hash":
+		return HashPlacement, nil
+	}
+	return nil, fmt.Errorf("unknown placement policy `%s` (use parent, free-space, round-robin or hash)", name)
+}
+
+// Returns true if the node's local tree can contain the path (an empty mount point is the root)
+func canStore(mountPoint string, path string) bool {
+	if mountPoint == "" {
+		return path != ""
+	}
+	return strings.HasPrefix(path, mountPoint+"/")
+}
+
+// Returns available nodes (this one included) which can store the path, ordered by name
+func (c *Cluster) placementCandidates(path string) []*NodeInfo {
+	candidates := make([]*NodeInfo, 0)
+	if c.LocalFs.CanStore(path) {
+		candidates = append(candidates, c.Me)
+	}
+	for _, node := range c.GetPeers() {
+		node.Lock()
+		mountPoint := node.DfsMountPoint
+		node.Unlock()
+		if canStore(mountPoint, path) && c.IsNodeAvailable(node.Name) {
+			candidates = append(candidates, node)
+		}
+	}
+	utils.SortSlice(candidates, func(l, r interface{}) bool {
+		return l.(*NodeInfo).Name < r.(*NodeInfo).Name
+	})
+	return candidates
+}
+
+// Chooses the node to create the path on
+func (c *Cluster) PlaceNew(path string) (string, error) {
+	candidates := c.placementCandidates(path)
+	if len(candidates) == 0 {
+		return "", NoWritableNodeError
+	}
+	return c.Placement.Place(c, path, candidates).Name, nil
+}
@@ -2,19 +2,25 @@ package cluster
 
 import (
 	"dftp/dfsfat"
+	"dftp/filecache"
 	"dftp/localfs"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"path/filepath"
 	"sync"
 )
 
 // Transparent handling of local or remote file operations
 type Proxy struct {
-	Cluster      *Cluster
-	LocalFs      *localfs.LocalFs
+	Cluster *Cluster
+	LocalFs *localfs.LocalFs
+	// Cache of remote files; nil if disabled
+	Cache        *filecache.Cache
 	proxiesMutex sync.Mutex
 	proxies      map[string]*httputil.ReverseProxy
 	client       http.Client
@@ -22,21 +28,117 @@ type Proxy struct {
 
 const (
 	MaxRedirectDepth = 2
+	// User on whose behalf a peer forwards the request (see IsPeerRequest)
+	ForwardedUserHeader = "X-Dftp-User"
 )
 
 var (
 	TooManyRedirectsError = fmt.Errorf("too many proxy redirects while serving the file")
 	UnknownNodeError      = fmt.Errorf("file resides on unknown node")
+	NodeUnavailableError  = fmt.Errorf("file resides on unavailable node")
 )
 
 // Open file for reading.
+// Replicas are tried one by one (local one first) until one of them can be opened.
 // The caller must Close() the returned file afterwards.
-func (p *Proxy) OpenRead(path string, entry *dfsfat.TreeNodeReadonly, nRedirects int) (io.ReadCloser, error) {
-	if entry.OwnerNode == p.Cluster.LocalFs.MyNodeName {
-		f, err := p.Cluster.LocalFs.OpenRead(path)
+func (p *Proxy) OpenRead(path string, entry *dfsfat.TreeNodeReadonly, user string, nRedirects int) (io.ReadCloser, error) {
+	replicas := p.replicasToTry(entry)
+	if len(replicas) == 0 {
+		return nil, NodeUnavailableError
+	}
+	var lastErr error
+	for _, replica := range replicas {
+		f, err := p.openCachedReplica(replicaPath(path, replica), replica, 0, user, nRedirects)
+		if err == nil {
+			return f, nil
+		}
+		log.Printf("Proxy: cannot read %s from %s: %s", path, replica.OwnerNode, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Open file for reading starting from `offset`.
+// Unlike OpenRead, only replicas identical to the one described by entry.FileStat are tried,
+// so that parts of the file read separately always belong to the same version of it.
+// The caller must Close() the returned file afterwards.
+func (p *Proxy) OpenRange(path string, entry *dfsfat.TreeNodeReadonly, offset int64, user string, nRedirects int) (io.ReadCloser, error) {
+	replicas := make([]dfsfat.FileStat, 0, len(entry.Replicas))
+	for _, r := range p.replicasToTry(entry) {
+		if r.LastModified == entry.LastModified && r.SizeInBytes == entry.SizeInBytes {
+			replicas = append(replicas, r)
+		}
+	}
+	if len(replicas) == 0 {
+		return nil, NodeUnavailableError
+	}
+	var lastErr error
+	for _, replica := range replicas {
+		f, err := p.openCachedReplica(replicaPath(path, replica), replica, offset, user, nRedirects)
+		if err == nil {
+			return f, nil
+		}
+		log.Printf("Proxy: cannot read %s from %s at offset %d: %s", path, replica.OwnerNode, offset, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Returns available replicas of the entry, in order of preference
+func (p *Proxy) replicasToTry(entry *dfsfat.TreeNodeReadonly) []dfsfat.FileStat {
+	replicas := make([]dfsfat.FileStat, 0, len(entry.Replicas))
+	for _, r := range entry.Replicas {
+		if r.OwnerNode == p.LocalFs.MyNodeName {
+			replicas = append([]dfsfat.FileStat{r}, replicas...)
+		} else if p.Cluster.IsNodeAvailable(r.OwnerNode) {
+			replicas = append(replicas, r)
+		}
+	}
+	return replicas
+}
+
+// Path of the replica: entries exposing conflicting replicas are named differently
+func replicaPath(path string, replica dfsfat.FileStat) string {
+	if filepath.Base(path) == replica.Basename {
+		return path
+	}
+	return filepath.Join(filepath.Dir(path), replica.Basename)
+}
+
+// Opens the replica, reading remote replicas through the cache (if enabled)
+func (p *Proxy) openCachedReplica(path string, replica dfsfat.FileStat, offset int64, user string, nRedirects int) (io.ReadCloser, error) {
+	if p.Cache == nil || replica.OwnerNode == p.LocalFs.MyNodeName {
+		return p.openReplica(path, replica.OwnerNode, offset, user, nRedirects)
+	}
+	// modified replicas get different keys, so stale entries are never read (and eventually evicted)
+	key := fmt.Sprintf("%s\x00%s\x00%d\x00%d", path, replica.OwnerNode, replica.LastModified, replica.SizeInBytes)
+	if f, ok := p.Cache.Open(key); ok {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	f, err := p.openReplica(path, replica.OwnerNode, offset, user, nRedirects)
+	if err != nil || offset > 0 {
+		// only complete files are cached
+		return f, err
+	}
+	return p.Cache.Fill(key, f, replica.SizeInBytes), nil
+}
+
+func (p *Proxy) openReplica(path string, owner string, offset int64, user string, nRedirects int) (io.ReadCloser, error) {
+	if owner == p.LocalFs.MyNodeName {
+		f, err := p.LocalFs.OpenRead(path)
 		if err != nil {
 			return nil, err
 		}
+		if offset > 0 {
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
 		return f, nil
 	}
 
@@ -46,21 +148,46 @@ func (p *Proxy) OpenRead(path string, entry *dfsfat.TreeNodeReadonly, nRedirects
 	nRedirects += 1
 
 	p.Cluster.RLock()
-	node, ok := p.Cluster.Peers[entry.OwnerNode]
+	node, ok := p.Cluster.Peers[owner]
 	p.Cluster.RUnlock()
 	if !ok {
 		return nil, UnknownNodeError
 	}
+	if !p.Cluster.IsNodeAvailable(owner) {
+		return nil, NodeUnavailableError
+	}
 
-	url := fmt.Sprintf("http://%s/fs/%s?redirN=%d", node.PublicAddr, path, nRedirects)
-	resp, err := p.client.Get(url)
+	// `owner` asks the peer to serve its own replica
+	fileUrl := fmt.Sprintf("%s://%s/fs/%s?redirN=%d&owner=%s", p.Cluster.publicScheme(), node.PublicAddr, path, nRedirects, url.QueryEscape(owner))
+	req, err := http.NewRequest("GET", fileUrl, nil)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("proxy error: %s", resp.Status)
+	if err := p.Cluster.signForwarded(req, user); err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			// the peer ignored the range: skip to the offset
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+		return resp.Body, nil
 	}
-	return resp.Body, nil
+	resp.Body.Close()
+	return nil, fmt.Errorf("proxy error: %s", resp.Status)
 }
 
 func NewProxy(cluster *Cluster, localfs *localfs.LocalFs) *Proxy {
@@ -84,9 +211,9 @@ func (p *Proxy) GetHttpProxy(nodeName string) *httputil.ReverseProxy {
 			return nil
 		}
 
-		proxy = &httputil.ReverseProxy{}
+		proxy = &httputil.ReverseProxy{Transport: p.client.Transport}
 		proxy.Director = func(r *http.Request) {
-			r.URL.Scheme = "http"
+			r.URL.Scheme = p.Cluster.publicScheme()
 			r.URL.Host = node.PublicAddr
 			log.Printf("Proxy download request to %s", r.URL)
 		}
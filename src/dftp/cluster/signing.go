@@ -0,0 +1,370 @@
+package cluster
+
+/*
+* Signed peer-to-peer messages.
+*
+* With a cluster secret configured, every request a node makes to the management interface
+* of a peer is signed with HMAC-SHA256 keyed by the secret, shared by every node of the cluster.
+* The signature covers the method, path and query, sender node name, time, a random nonce
+* and a digest of the body. Peer endpoints (greetings, updates, probes) reject requests which
+* are not signed, are signed with another secret, are too old or have been seen before,
+* and the sender name inside the request must match the signed one.
+*
+* Responses are signed too, together with the signature of the request, so a response cannot
+* be forged or replayed. Discovery pings carry a signature of their own.
+*
+* Requests forwarded to the public interface of a peer on behalf of a user are signed as well
+* (the method, path and query, user, sender node, time and nonce; not the body, which is
+* streamed), so that the peer can trust the user (see IsPeerRequest).
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"dftp/auth"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SenderNodeHeader        = "X-Dftp-Node"
+	SignatureTimeHeader     = "X-Dftp-Time"
+	SignatureNonceHeader    = "X-Dftp-Nonce"
+	SignatureHeader         = "X-Dftp-Signature"
+	ResponseSignatureHeader = "X-Dftp-Response-Signature"
+
+	// Signed requests and pings older (or newer) than that are rejected
+	MaxSignatureAge = 5 * time.Minute
+)
+
+var (
+	UnsignedRequestError  = fmt.Errorf("request is not signed")
+	InvalidSignatureError = fmt.Errorf("invalid signature")
+	StaleSignatureError   = fmt.Errorf("signature is too old or too far in the future")
+	ReplayedRequestError  = fmt.Errorf("request has been seen before")
+)
+
+type messageSigner struct {
+	key []byte
+
+	// signatures of requests received within MaxSignatureAge -> when they expire
+	seenLock sync.Mutex
+	seen     map[string]time.Time
+}
+
+// Enables signing of management requests and discovery pings with the secret read from the file.
+// Must be called before the cluster starts communicating.
+func (c *Cluster) EnableSigning(secretFile string) error {
+	data, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		return err
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) < auth.MinSigningKeyLength {
+		return fmt.Errorf("%s: cluster secret must be at least %d bytes long", secretFile, auth.MinSigningKeyLength)
+	}
+	c.signer = &messageSigner{
+		key:  key,
+		seen: make(map[string]time.Time),
+	}
+	return nil
+}
+
+func (s *messageSigner) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, s.key)
+	for _, p := range parts {
+		fmt.Fprintf(mac, "%d:%s\n", len(p), p)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *messageSigner) valid(signature string, parts ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(s.sign(parts...)))
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func isFresh(unixMillis int64) bool {
+	age := time.Since(time.Unix(0, unixMillis*int64(time.Millisecond)))
+	return age < MaxSignatureAge && age > -MaxSignatureAge
+}
+
+// Remembers the request signature; returns false if it has been seen before
+func (s *messageSigner) firstSeen(signature string) bool {
+	s.seenLock.Lock()
+	defer s.seenLock.Unlock()
+	now := time.Now()
+	for sig, expires := range s.seen {
+		if now.After(expires) {
+			delete(s.seen, sig)
+		}
+	}
+	if _, ok := s.seen[signature]; ok {
+		return false
+	}
+	// a request is fresh for MaxSignatureAge either way from its time
+	s.seen[signature] = now.Add(2 * MaxSignatureAge)
+	return true
+}
+
+func requestSignatureParts(r *http.Request, body []byte) []string {
+	return []string{
+		r.Method,
+		r.URL.RequestURI(),
+		r.Header.Get(SenderNodeHeader),
+		r.Header.Get(SignatureTimeHeader),
+		r.Header.Get(SignatureNonceHeader),
+		bodyDigest(body),
+	}
+}
+
+func responseSignatureParts(r *http.Request, status int, body []byte) []string {
+	return []string{
+		r.Header.Get(SignatureHeader),
+		strconv.Itoa(status),
+		bodyDigest(body),
+	}
+}
+
+// Sends a request to the management interface of a peer; signs it and checks the signature
+// of a successful response if the cluster secret is set. Returns the response with its body read.
+func (c *Cluster) mgmtRequest(method string, addr string, pathAndQuery string, contentType string, body []byte) (*http.Response, []byte, error) {
+	return c.mgmtRequestContext(context.Background(), method, addr, pathAndQuery, contentType, body)
+}
+
+func (c *Cluster) mgmtRequestContext(ctx context.Context, method string, addr string, pathAndQuery string, contentType string, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.mgmtUrl(addr, pathAndQuery), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.signer != nil {
+		nonce := make([]byte, 12)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set(SenderNodeHeader, c.Me.Name)
+		req.Header.Set(SignatureTimeHeader, fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond)))
+		req.Header.Set(SignatureNonceHeader, hex.EncodeToString(nonce))
+		req.Header.Set(SignatureHeader, c.signer.sign(requestSignatureParts(req, body)...))
+	}
+
+	r, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Body.Close()
+	respBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	// error responses are only logged, and need not be verified
+	if c.signer != nil && r.StatusCode == http.StatusOK {
+		signature := r.Header.Get(ResponseSignatureHeader)
+		if !c.signer.valid(signature, responseSignatureParts(req, r.StatusCode, respBody)...) {
+			return nil, nil, fmt.Errorf("invalid response signature")
+		}
+	}
+	return r, respBody, nil
+}
+
+// Checks the signature of a request to a peer endpoint; returns the name of the signed sender
+func (c *Cluster) verifyRequest(r *http.Request, body []byte) (string, error) {
+	signature := r.Header.Get(SignatureHeader)
+	if signature == "" {
+		return "", UnsignedRequestError
+	}
+	if !c.signer.valid(signature, requestSignatureParts(r, body)...) {
+		return "", InvalidSignatureError
+	}
+	millis, err := strconv.ParseInt(r.Header.Get(SignatureTimeHeader), 10, 64)
+	if err != nil || !isFresh(millis) {
+		return "", StaleSignatureError
+	}
+	if !c.signer.firstSeen(signature) {
+		return "", ReplayedRequestError
+	}
+	return r.Header.Get(SenderNodeHeader), nil
+}
+
+// Buffers a response to be signed
+type signedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *signedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// Wraps a handler of requests made by peers. If the cluster secret is set, the requests
+// must be signed (except for `unsignedMethods`, which administrators may use too),
+// and responses to signed requests are signed.
+// The handler finds the verified sender name in the SenderNodeHeader header; it is empty if the
+// request is not signed.
+func (c *Cluster) signedHandler(handler func(http.ResponseWriter, *http.Request), unsignedMethods ...string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.signer == nil || (r.Header.Get(SignatureHeader) == "" && containsString(unsignedMethods, r.Method)) {
+			r.Header.Del(SenderNodeHeader)
+			handler(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sender, err := c.verifyRequest(r, body)
+		if err != nil {
+			log.Printf("WARN: rejected %s %s from %s (node `%s`): %s", r.Method, r.URL.Path, r.RemoteAddr, r.Header.Get(SenderNodeHeader), err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.Header.Set(SenderNodeHeader, sender)
+
+		sw := &signedResponseWriter{ResponseWriter: w}
+		handler(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		respBody := sw.body.Bytes()
+		w.Header().Set(ResponseSignatureHeader, c.signer.sign(responseSignatureParts(r, sw.status, respBody)...))
+		w.WriteHeader(sw.status)
+		w.Write(respBody)
+	}
+}
+
+// Rejects a request whose content claims to come from another node than the signed sender.
+// Returns false (having responded) if the names differ.
+func checkSender(w http.ResponseWriter, r *http.Request, name string) bool {
+	sender := r.Header.Get(SenderNodeHeader)
+	if sender == "" || sender == name {
+		return true
+	}
+	log.Printf("WARN: rejected %s %s from %s: signed by `%s` on behalf of `%s`", r.Method, r.URL.Path, r.RemoteAddr, sender, name)
+	http.Error(w, fmt.Sprintf("request signed by `%s` cannot be made on behalf of `%s`", sender, name), http.StatusForbidden)
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Signs a request forwarded to the public interface of a peer on behalf of `user`,
+// if the cluster secret is set
+func (c *Cluster) signForwarded(req *http.Request, user string) error {
+	req.Header.Set(ForwardedUserHeader, user)
+	if c.signer == nil {
+		return nil
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	req.Header.Set(SenderNodeHeader, c.Me.Name)
+	req.Header.Set(SignatureTimeHeader, fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond)))
+	req.Header.Set(SignatureNonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(SignatureHeader, c.signer.sign(forwardedSignatureParts(req)...))
+	return nil
+}
+
+// Checks the signature of a request forwarded by a peer
+func (c *Cluster) verifyForwarded(r *http.Request) error {
+	signature := r.Header.Get(SignatureHeader)
+	if signature == "" {
+		return UnsignedRequestError
+	}
+	if !c.signer.valid(signature, forwardedSignatureParts(r)...) {
+		return InvalidSignatureError
+	}
+	millis, err := strconv.ParseInt(r.Header.Get(SignatureTimeHeader), 10, 64)
+	if err != nil || !isFresh(millis) {
+		return StaleSignatureError
+	}
+	if !c.signer.firstSeen(signature) {
+		return ReplayedRequestError
+	}
+	return nil
+}
+
+func forwardedSignatureParts(r *http.Request) []string {
+	return []string{
+		// not to be confused with management requests
+		"forwarded",
+		r.Method,
+		r.URL.RequestURI(),
+		r.Header.Get(ForwardedUserHeader),
+		r.Header.Get(SenderNodeHeader),
+		r.Header.Get(SignatureTimeHeader),
+		r.Header.Get(SignatureNonceHeader),
+	}
+}
+
+// Signs the discovery ping, if the cluster secret is set
+func (c *Cluster) signPing(ping *DiscoveryPing) {
+	if c.signer == nil {
+		return
+	}
+	ping.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	ping.Signature = c.signer.sign(pingSignatureParts(ping)...)
+}
+
+// Checks the signature of a received discovery ping, if the cluster secret is set
+func (c *Cluster) verifyPing(ping *DiscoveryPing) error {
+	if c.signer == nil {
+		return nil
+	}
+	if ping.Signature == "" {
+		return UnsignedRequestError
+	}
+	if !c.signer.valid(ping.Signature, pingSignatureParts(ping)...) {
+		return InvalidSignatureError
+	}
+	if !isFresh(ping.Time) {
+		return StaleSignatureError
+	}
+	return nil
+}
+
+func pingSignatureParts(ping *DiscoveryPing) []string {
+	return []string{
+		ping.Type,
+		ping.ClusterName,
+		ping.NodeName,
+		ping.MgmtAddr,
+		fmt.Sprintf("%d", ping.Time),
+	}
+}
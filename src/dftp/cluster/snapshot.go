@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"compress/gzip"
+	"dftp/dfsfat"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+* Snapshots of the DFS tree.
+*
+* A snapshot contains every replica known to this node (including tombstones), and,
+* for every peer, its addresses, mount point and the last update received from it.
+* Loading a snapshot at startup allows serving files immediately; the local tree is then
+* rescanned, and peers are asked only for the updates made since the snapshot was taken.
+* Membership and liveness of the peers are learned anew by probing them.
+ */
+
+const (
+	SnapshotVersion = 3
+)
+
+type Snapshot struct {
+	Version  int
+	NodeName string
+	SavedAt  int64
+	Peers    []*PeerPosition
+	Files    []*dfsfat.FileAnnouncement
+}
+
+type PeerPosition struct {
+	Name                    string
+	PublicAddr              string
+	MgmtAddr                string
+	DfsMountPoint           string
+	LastUpdateReceivedEpoch int64
+	LastUpdateReceivedSeq   int64
+}
+
+// Writes snapshot to a temporary file, then atomically replaces `path` with it
+func (c *Cluster) SaveSnapshot(path string) error {
+	snap := &Snapshot{
+		Version:  SnapshotVersion,
+		NodeName: c.Me.Name,
+		SavedAt:  time.Now().Unix(),
+	}
+	for _, node := range c.GetPeers() {
+		node.Lock()
+		snap.Peers = append(snap.Peers, &PeerPosition{
+			Name:                    node.Name,
+			PublicAddr:              node.PublicAddr,
+			MgmtAddr:                node.MgmtAddr,
+			DfsMountPoint:           node.DfsMountPoint,
+			LastUpdateReceivedEpoch: node.LastUpdateReceivedEpoch,
+			LastUpdateReceivedSeq:   node.LastUpdateReceivedSeq,
+		})
+		node.Unlock()
+	}
+	snap.Files = c.DfsRoot.Export()
+
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(snap)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	log.Printf("Snapshot: saved %d item(s) to %s", len(snap.Files), path)
+	return nil
+}
+
+// Loads snapshot into the DFS tree and registers peers mentioned in it.
+// Must be called before the local tree is scanned.
+func (c *Cluster) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	snap := &Snapshot{}
+	err = json.NewDecoder(zr).Decode(snap)
+	if err != nil {
+		return err
+	}
+	if snap.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	if snap.NodeName != c.Me.Name {
+		return fmt.Errorf("snapshot belongs to node %s", snap.NodeName)
+	}
+
+	c.DfsRoot.Update(snap.Files)
+	// information produced after restart must supersede the saved one, even if the clock went back
+	for _, fa := range snap.Files {
+		c.LocalFs.Clock.Observe(fa.InfoVersion)
+	}
+
+	now := time.Now().Unix()
+	for _, p := range snap.Peers {
+		if p.Name == c.Me.Name {
+			continue
+		}
+		c.Lock()
+		_, known := c.Peers[p.Name]
+		if !known {
+			c.Peers[p.Name] = &NodeInfo{
+				Name:                    p.Name,
+				PublicAddr:              p.PublicAddr,
+				MgmtAddr:                p.MgmtAddr,
+				DfsMountPoint:           p.DfsMountPoint,
+				LastAlive:               now,
+				LastUpdateReceivedEpoch: p.LastUpdateReceivedEpoch,
+				LastUpdateReceivedSeq:   p.LastUpdateReceivedSeq,
+			}
+		}
+		c.Unlock()
+	}
+	log.Printf("Snapshot: loaded %d item(s) and %d peer(s) saved at %s", len(snap.Files), len(snap.Peers), time.Unix(snap.SavedAt, 0))
+
+	// peers learn about the restart from gossip; ask them for what we have missed meanwhile
+	for _, node := range c.GetPeers() {
+		go c.PullUpdate(node)
+	}
+	return nil
+}
+
+func (c *Cluster) StartPeriodicSnapshots(path string, period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	go func() {
+		for _ = range time.NewTicker(period).C {
+			if err := c.SaveSnapshot(path); err != nil {
+				log.Printf("Snapshot: ERROR: %s", err)
+			}
+		}
+	}()
+}
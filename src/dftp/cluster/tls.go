@@ -0,0 +1,169 @@
+package cluster
+
+/*
+* TLS for communication between nodes.
+*
+* With mutual TLS enabled, every node has a certificate issued by the cluster CA.
+* The management interface accepts only clients presenting such a certificate, and nodes
+* present theirs when calling each other, so only nodes of the cluster can join it or push updates.
+* Requests forwarded to the public interface of other nodes carry the certificate too,
+* which lets the owner trust the user they are made on behalf of.
+*
+* Peers are addressed by IP, so certificates of the cluster CA are not checked against
+* the address. Public interfaces may also use certificates of public CAs; these must be
+* valid for the address the interface is called by, as usual.
+ */
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+)
+
+type clusterTLS struct {
+	cert tls.Certificate
+	// cluster CA
+	caPool *x509.CertPool
+}
+
+// Enables mutual TLS of the management interface and peer-to-peer traffic.
+// Must be called before the cluster starts communicating.
+func (c *Cluster) EnableMutualTLS(caFile string, certFile string, keyFile string) error {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s: no CA certificates found", caFile)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.tls = &clusterTLS{cert: cert, caPool: caPool}
+
+	c.client.Transport.(*http.Transport).TLSClientConfig = c.tls.clientConfig(nil)
+	// public interfaces may use certificates of other CAs
+	publicPool, err := x509.SystemCertPool()
+	if err != nil {
+		publicPool = x509.NewCertPool()
+	}
+	c.Proxy.client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: c.tls.clientConfig(publicPool),
+	}
+	return nil
+}
+
+// Client configuration presenting the node certificate. Servers with a certificate of the
+// cluster CA are accepted whatever their address; if `publicPool` is given, so are servers
+// with a certificate of its CAs valid for the host name (or IP) they are called by.
+func (t *clusterTLS) clientConfig(publicPool *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.cert},
+		// verified by VerifyConnection: host names are not checked for the cluster CA
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			err := verifyServerChain(cs.PeerCertificates, t.caPool, "")
+			if err != nil && publicPool != nil {
+				err = verifyServerChain(cs.PeerCertificates, publicPool, cs.ServerName)
+			}
+			return err
+		},
+	}
+}
+
+// Verifies the server certificate against the pool, and against the host name unless it is empty
+func verifyServerChain(certs []*x509.Certificate, pool *x509.CertPool, host string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// Server configuration of the management interface; nil if mutual TLS is disabled
+func (c *Cluster) mgmtTLSConfig() *tls.Config {
+	if c.tls == nil {
+		return nil
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{c.tls.cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    c.tls.caPool,
+	}
+}
+
+// Server configuration of the public interface: asks peers for their certificates
+// (see IsPeerRequest), but does not require them
+func (c *Cluster) PublicTLSConfig() *tls.Config {
+	config := &tls.Config{}
+	if c.tls != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = c.tls.caPool
+	}
+	return config
+}
+
+// URL of the management interface of a peer
+func (c *Cluster) mgmtUrl(addr string, pathAndQuery string) string {
+	scheme := "http"
+	if c.tls != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, addr, pathAndQuery)
+}
+
+// Scheme of public interfaces of peers
+func (c *Cluster) publicScheme() string {
+	if c.PublicTLS {
+		return "https"
+	}
+	return "http"
+}
+
+// Returns true if the request is authenticated as coming from a peer, so that the user
+// it is forwarded on behalf of can be trusted: it must carry a certificate of the cluster CA,
+// or, without mutual TLS, be signed with the cluster secret. Without either of them
+// no request is trusted, whatever host it comes from.
+func (c *Cluster) IsPeerRequest(r *http.Request) bool {
+	if c.tls != nil {
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	}
+	if c.signer != nil {
+		if err := c.verifyForwarded(r); err != nil {
+			log.Printf("WARN: not trusting user `%s` of %s %s from %s: %s", r.Header.Get(ForwardedUserHeader), r.Method, r.URL.Path, r.RemoteAddr, err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Returns true if administrative requests are allowed from the client: with mutual TLS
+// it has presented a certificate of the cluster CA, otherwise it must be this host
+func (c *Cluster) isAdminRequest(r *http.Request) bool {
+	if c.tls != nil {
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"dftp/dfsfat"
+	"sync"
+	"time"
+)
+
+/*
+* Log of recent local changes, used for incremental updates.
+*
+* Every batch of local changes gets the next sequence number. A peer which has seen
+* everything up to sequence N is brought up to date by sending the batches after N,
+* as long as they are still kept in the log; otherwise it gets a full update.
+*
+* Sequence numbers are only meaningful within the same epoch. A new epoch starts
+* every time the node starts.
+ */
+
+const (
+	// Maximum total number of file announcements kept in the log
+	UpdateLogMaxFiles = 100000
+)
+
+type UpdateLog struct {
+	sync.RWMutex
+	Epoch   int64
+	lastSeq int64
+	batches []updateBatch
+	nFiles  int
+}
+
+type updateBatch struct {
+	seq   int64
+	files []*dfsfat.FileAnnouncement
+}
+
+func NewUpdateLog() *UpdateLog {
+	return &UpdateLog{
+		Epoch: time.Now().UnixNano(),
+	}
+}
+
+// Appends a batch of changes, returns its sequence number
+func (l *UpdateLog) Append(files []*dfsfat.FileAnnouncement) int64 {
+	l.Lock()
+	defer l.Unlock()
+	l.lastSeq += 1
+	l.batches = append(l.batches, updateBatch{seq: l.lastSeq, files: files})
+	l.nFiles += len(files)
+	for len(l.batches) > 1 && l.nFiles > UpdateLogMaxFiles {
+		l.nFiles -= len(l.batches[0].files)
+		l.batches = l.batches[1:]
+	}
+	return l.lastSeq
+}
+
+func (l *UpdateLog) LastSeq() int64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.lastSeq
+}
+
+// Returns all changes made after sequence `since`, and the sequence they bring the receiver to.
+// If some of these changes are no longer kept, returns ok = false.
+func (l *UpdateLog) Since(since int64) (files []*dfsfat.FileAnnouncement, seq int64, ok bool) {
+	l.RLock()
+	defer l.RUnlock()
+	if since > l.lastSeq || since < 0 {
+		return nil, 0, false
+	}
+	if since == l.lastSeq {
+		return []*dfsfat.FileAnnouncement{}, l.lastSeq, true
+	}
+	if len(l.batches) == 0 || l.batches[0].seq > since+1 {
+		return nil, 0, false
+	}
+
+	// later changes of the same file supersede earlier ones
+	latest := make(map[string]int)
+	for _, b := range l.batches {
+		if b.seq <= since {
+			continue
+		}
+		for _, fa := range b.files {
+			if i, ok := latest[fa.FullName]; ok {
+				files[i] = fa
+			} else {
+				latest[fa.FullName] = len(files)
+				files = append(files, fa)
+			}
+		}
+	}
+	return files, l.lastSeq, true
+}
@@ -0,0 +1,252 @@
+package cluster
+
+/*
+* Write operations on the distributed file system.
+*
+* New files and directories are created on the node chosen by the placement policy
+* (see placement.go). Existing files are overwritten on a single replica: on this node if it
+* has one, otherwise on the node owning the primary replica. Other replicas of the file are
+* left as they are, and conflict with the written one afterwards (see dfsfat/conflict.go).
+* Removals and renames are made on every node owning a replica of the entry.
+*
+* Operations on other nodes are forwarded to their public HTTP interface with the `owner`
+* parameter set and the user in ForwardedUserHeader; the announcements they respond with
+* are applied to the local tree at once.
+ */
+
+import (
+	"dftp/dfsfat"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	NoWritableNodeError = fmt.Errorf("no node can store the path")
+	PathNotFoundError   = fmt.Errorf("path not found in DFS")
+)
+
+// Error reported by the node a write has been forwarded to
+type ForwardedError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ForwardedError) Error() string {
+	return e.Message
+}
+
+func parentPath(path string) string {
+	dir := filepath.Dir(path)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
+
+func ownersOf(stat *dfsfat.FileStat) []string {
+	if len(stat.Owners) == 0 {
+		return []string{stat.OwnerNode}
+	}
+	return stat.Owners
+}
+
+// Chooses the node to write the file on
+func (p *Proxy) writeTarget(path string) (string, error) {
+	entry := p.Cluster.DfsRoot.Seek(path)
+	if entry != nil {
+		ro := entry.GetReadonly()
+		if !ro.IsDir() && p.Cluster.IsVisible(&ro.FileStat) {
+			for _, owner := range ownersOf(&ro.FileStat) {
+				if owner == p.LocalFs.MyNodeName {
+					return owner, nil
+				}
+			}
+			return ro.OwnerNode, nil
+		}
+	}
+	return p.Cluster.PlaceNew(path)
+}
+
+// Returns nodes owning live replicas of the path
+func (p *Proxy) replicaOwners(path string) ([]string, error) {
+	entry := p.Cluster.DfsRoot.Seek(path)
+	if entry == nil {
+		return nil, PathNotFoundError
+	}
+	ro := entry.GetReadonly()
+	if !p.Cluster.IsVisible(&ro.FileStat) {
+		return nil, PathNotFoundError
+	}
+	return ownersOf(&ro.FileStat), nil
+}
+
+// Writes `data` into the file (appending to it if `appendData`).
+// If `owner` is empty, the node to store the file is chosen automatically.
+func (p *Proxy) WriteFile(path string, data io.Reader, appendData bool, owner string, user string, nRedirects int) (int64, []*dfsfat.FileAnnouncement, error) {
+	if owner == "" {
+		var err error
+		owner, err = p.writeTarget(path)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if owner == p.LocalFs.MyNodeName {
+		return p.LocalFs.WriteFile(path, data, appendData)
+	}
+	vals := url.Values{}
+	if appendData {
+		vals.Set("append", "true")
+	}
+	counter := &countingReader{r: data}
+	files, err := p.forwardWrite("PUT", path, owner, vals, nil, counter, user, nRedirects)
+	return counter.n, files, err
+}
+
+// Creates a directory. If `owner` is empty, the node to create it on is chosen automatically.
+func (p *Proxy) MakeDir(path string, owner string, user string, nRedirects int) ([]*dfsfat.FileAnnouncement, error) {
+	if owner == "" {
+		var err error
+		owner, err = p.Cluster.PlaceNew(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if owner == p.LocalFs.MyNodeName {
+		return p.LocalFs.MakeDir(path)
+	}
+	return p.forwardWrite("MKCOL", path, owner, nil, nil, nil, user, nRedirects)
+}
+
+// Removes the file or directory from every node owning it (or only from `owner`, if not empty)
+func (p *Proxy) Remove(path string, recursive bool, owner string, user string, nRedirects int) ([]*dfsfat.FileAnnouncement, error) {
+	vals := url.Values{}
+	if recursive {
+		vals.Set("recursive", "true")
+	}
+	return p.onEveryOwner(path, owner, func(owner string) ([]*dfsfat.FileAnnouncement, error) {
+		if owner == p.LocalFs.MyNodeName {
+			return p.LocalFs.Remove(path, recursive)
+		}
+		return p.forwardWrite("DELETE", path, owner, vals, nil, nil, user, nRedirects)
+	})
+}
+
+// Renames the file or directory on every node owning it (or only on `owner`, if not empty)
+func (p *Proxy) Rename(from string, to string, owner string, user string, nRedirects int) ([]*dfsfat.FileAnnouncement, error) {
+	header := http.Header{}
+	header.Set("Destination", "/fs/"+to)
+	return p.onEveryOwner(from, owner, func(owner string) ([]*dfsfat.FileAnnouncement, error) {
+		if owner == p.LocalFs.MyNodeName {
+			return p.LocalFs.Rename(from, to)
+		}
+		return p.forwardWrite("MOVE", from, owner, nil, header, nil, user, nRedirects)
+	})
+}
+
+func (p *Proxy) onEveryOwner(path string, owner string, op func(owner string) ([]*dfsfat.FileAnnouncement, error)) ([]*dfsfat.FileAnnouncement, error) {
+	owners := []string{owner}
+	if owner == "" {
+		var err error
+		owners, err = p.replicaOwners(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	allFiles := make([]*dfsfat.FileAnnouncement, 0)
+	var firstErr error
+	for _, owner := range owners {
+		files, err := op(owner)
+		allFiles = append(allFiles, files...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return allFiles, firstErr
+}
+
+func (p *Proxy) forwardWrite(method string, path string, owner string, vals url.Values, header http.Header, body io.Reader, user string, nRedirects int) ([]*dfsfat.FileAnnouncement, error) {
+	if nRedirects >= MaxRedirectDepth {
+		return nil, TooManyRedirectsError
+	}
+	nRedirects += 1
+
+	p.Cluster.RLock()
+	node, ok := p.Cluster.Peers[owner]
+	p.Cluster.RUnlock()
+	if !ok {
+		return nil, UnknownNodeError
+	}
+	if !p.Cluster.IsNodeAvailable(owner) {
+		return nil, NodeUnavailableError
+	}
+
+	if vals == nil {
+		vals = url.Values{}
+	}
+	vals.Set("redirN", fmt.Sprintf("%d", nRedirects))
+	vals.Set("owner", owner)
+	fileUrl := &url.URL{
+		Scheme:   p.Cluster.publicScheme(),
+		Host:     node.PublicAddr,
+		Path:     "/fs/" + path,
+		RawQuery: vals.Encode(),
+	}
+	req, err := http.NewRequest(method, fileUrl.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := p.Cluster.signForwarded(req, user); err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		s, _ := ioutil.ReadAll(resp.Body)
+		return nil, &ForwardedError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(s)),
+		}
+	}
+
+	files := make([]*dfsfat.FileAnnouncement, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, err
+	}
+	// do not wait for the owner to push the changes
+	p.Cluster.ApplyAnnouncements(files)
+	return files, nil
+}
+
+// Applies file announcements received out of the regular update flow
+func (c *Cluster) ApplyAnnouncements(files []*dfsfat.FileAnnouncement) {
+	if len(files) == 0 {
+		return
+	}
+	for _, fa := range files {
+		c.LocalFs.Clock.Observe(fa.InfoVersion)
+	}
+	c.DfsRoot.Update(files)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
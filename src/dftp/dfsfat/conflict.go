@@ -0,0 +1,196 @@
+package dfsfat
+
+/*
+* Resolution of conflicts between replicas.
+*
+* Replicas of a file conflict if they differ in size or modification time.
+* Conflict policy decides which replica provides attributes of the file (and is read first).
+* Policies which expose all replicas additionally make every losing replica available
+* as a separate entry named <name>@<owner node>.
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ConflictPolicy interface {
+	// Returns true if replica a should be preferred over replica b
+	Prefer(a, b *FileStat) bool
+	// Returns true if losing replicas should be exposed as separate entries
+	ExposeAll() bool
+}
+
+type newestMtimePolicy struct{}
+
+func (p newestMtimePolicy) Prefer(a, b *FileStat) bool {
+	if a.LastModified != b.LastModified {
+		return a.LastModified > b.LastModified
+	}
+	return tieBreak(a, b)
+}
+
+func (p newestMtimePolicy) ExposeAll() bool {
+	return false
+}
+
+type largestPolicy struct{}
+
+func (p largestPolicy) Prefer(a, b *FileStat) bool {
+	if a.SizeInBytes != b.SizeInBytes {
+		return a.SizeInBytes > b.SizeInBytes
+	}
+	return newestMtimePolicy{}.Prefer(a, b)
+}
+
+func (p largestPolicy) ExposeAll() bool {
+	return false
+}
+
+type exposeAllPolicy struct {
+	newestMtimePolicy
+}
+
+func (p exposeAllPolicy) ExposeAll() bool {
+	return true
+}
+
+// Replicas with identical attributes: prefer the most recently announced one,
+// then the one of the node whose name goes first.
+func tieBreak(a, b *FileStat) bool {
+	if a.InfoVersion != b.InfoVersion {
+		return a.InfoVersion > b.InfoVersion
+	}
+	return a.OwnerNode < b.OwnerNode
+}
+
+var (
+	NewestMtimeWins   ConflictPolicy = newestMtimePolicy{}
+	LargestWins       ConflictPolicy = largestPolicy{}
+	ExposeAllReplicas ConflictPolicy = exposeAllPolicy{}
+
+	conflictPolicy = NewestMtimeWins
+)
+
+// Must be called before the tree is populated
+func SetConflictPolicy(policy ConflictPolicy) {
+	conflictPolicy = policy
+}
+
+func ConflictPolicyByName(name string) (ConflictPolicy, error) {
+	switch name {
+	case "newest":
+		return NewestMtimeWins, nil
+	case "largest":
+		return LargestWins, nil
+	case "both":
+		return ExposeAllReplicas, nil
+	}
+	return nil, fmt.Errorf("unknown conflict policy `%s` (use newest, largest or both)", name)
+}
+
+func replicasConflict(a, b *FileStat) bool {
+	return !a.Dir && !b.Dir && (a.SizeInBytes != b.SizeInBytes || a.LastModified != b.LastModified)
+}
+
+// Name of the entry exposing a losing replica
+func ReplicaEntryName(basename string, owner string) string {
+	return basename + "@" + owner
+}
+
+// Returns a detached node representing the losing replica owned by `owner`, or nil
+func (n *TreeNode) conflictingReplica(owner string) *TreeNode {
+	n.RLock()
+	defer n.RUnlock()
+	for _, o := range n.conflicting {
+		if o == owner {
+			r := *n.replicas[owner]
+			v := &TreeNode{
+				fileStat: r,
+				replicas: map[string]*FileStat{owner: &r},
+			}
+			v.fileStat.Basename = ReplicaEntryName(r.Basename, owner)
+			v.fileStat.Owners = []string{owner}
+			return v
+		}
+	}
+	return nil
+}
+
+// Adds entries exposing losing replicas of the children (if the policy says so)
+func (n *TreeNode) addConflictingReplicas(children map[string]*TreeNode) {
+	if !conflictPolicy.ExposeAll() {
+		return
+	}
+	for name, entry := range n.childNodes {
+		entry.RLock()
+		conflicting := entry.conflicting
+		entry.RUnlock()
+		for _, owner := range conflicting {
+			if v := entry.conflictingReplica(owner); v != nil {
+				children[ReplicaEntryName(name, owner)] = v
+			}
+		}
+	}
+}
+
+// Resolves "<name>@<owner>" into a losing replica of child <name>
+func (n *TreeNode) seekConflictingReplica(name string) *TreeNode {
+	if !conflictPolicy.ExposeAll() {
+		return nil
+	}
+	i := strings.LastIndex(name, "@")
+	if i < 0 {
+		return nil
+	}
+	n.RLock()
+	entry, ok := n.childNodes[name[:i]]
+	n.RUnlock()
+	if !ok {
+		return nil
+	}
+	return entry.conflictingReplica(name[i+1:])
+}
+
+type Conflict struct {
+	Path     string
+	Winner   string
+	Replicas []FileStat
+}
+
+// Returns every file whose live replicas conflict with each other
+func (n *TreeNode) FindConflicts() []*Conflict {
+	conflicts := make([]*Conflict, 0)
+	n.findConflicts("", &conflicts)
+	return conflicts
+}
+
+func (n *TreeNode) findConflicts(basepath string, conflicts *[]*Conflict) {
+	n.RLock()
+	children := make(map[string]*TreeNode, len(n.childNodes))
+	for name, entry := range n.childNodes {
+		children[name] = entry
+	}
+	n.RUnlock()
+
+	for name, entry := range children {
+		path := name
+		if basepath != "" {
+			path = basepath + "/" + name
+		}
+		ro := entry.GetReadonly()
+		if len(ro.ChildNodes) > 0 {
+			entry.findConflicts(path, conflicts)
+		}
+		entry.RLock()
+		nConflicting := len(entry.conflicting)
+		entry.RUnlock()
+		if nConflicting > 0 {
+			*conflicts = append(*conflicts, &Conflict{
+				Path:     path,
+				Winner:   ro.OwnerNode,
+				Replicas: ro.Replicas,
+			})
+		}
+	}
+}
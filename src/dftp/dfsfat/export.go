@@ -0,0 +1,62 @@
+package dfsfat
+
+// Export() returns every replica of every entry in the tree, including tombstones,
+// so that the tree can be rebuilt later by Update().
+// Tombstones are exported as announcements of replicas with negative size rather than
+// as deletions, so that they are recreated upon import.
+func (n *TreeNode) Export() []*FileAnnouncement {
+	files := make([]*FileAnnouncement, 0)
+	n.export("", &files, 0)
+	return files
+}
+
+// ExportEntry() returns every replica of the entry at `path` (as found by Seek()) and of everything
+// inside it, including tombstones. If there are more than `limit` of them, returns nil and false.
+func (n *TreeNode) ExportEntry(path string, limit int) ([]*FileAnnouncement, bool) {
+	files := make([]*FileAnnouncement, 0)
+	n.RLock()
+	for _, r := range n.replicas {
+		files = append(files, &FileAnnouncement{
+			FullName: path,
+			FileStat: *r,
+		})
+	}
+	n.RUnlock()
+	if !n.export(path, &files, limit) {
+		return nil, false
+	}
+	return files, true
+}
+
+// Returns false as soon as there are more than `limit` files (if `limit` is positive)
+func (n *TreeNode) export(basepath string, files *[]*FileAnnouncement, limit int) bool {
+	n.RLock()
+	children := make(map[string]*TreeNode, len(n.childNodes))
+	for name, entry := range n.childNodes {
+		children[name] = entry
+	}
+	n.RUnlock()
+
+	for name, entry := range children {
+		path := name
+		if basepath != "" {
+			path = basepath + "/" + name
+		}
+		entry.RLock()
+		for _, r := range entry.replicas {
+			fa := &FileAnnouncement{
+				FullName: path,
+				FileStat: *r,
+			}
+			*files = append(*files, fa)
+		}
+		entry.RUnlock()
+		if limit > 0 && len(*files) > limit {
+			return false
+		}
+		if !entry.export(path, files, limit) {
+			return false
+		}
+	}
+	return true
+}
@@ -5,6 +5,7 @@ package dfsfat
 */
 
 import (
+	"dftp/utils"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,8 +18,16 @@ const (
 
 type TreeNode struct {
 	sync.RWMutex
-	fileStat   FileStat
-	childNodes map[string]*TreeNode
+	// fileStat is calculated from replicas and childNodes (see recalculate())
+	fileStat FileStat
+	// Information about the file from every node which has it.
+	// Replicas deleted from their nodes are kept as tombstones.
+	replicas map[string]*FileStat
+	// Owners of live replicas which conflict with the one chosen by conflict policy
+	conflicting []string
+	childNodes  map[string]*TreeNode
+	// Hash of replicas of the entry and of everything inside it (see merkle.go)
+	hash []byte
 }
 
 func NewRootNode() *TreeNode {
@@ -29,17 +38,23 @@ func NewRootNode() *TreeNode {
 
 type TreeNodeReadonly struct {
 	FileStat
+	// Live replicas, the one FileStat was taken from goes first
+	Replicas   []FileStat
 	ChildNodes map[string]*TreeNode
 }
 
 type FileStat struct {
-	Basename        string
-	Dir             bool
-	LastModified    int64
-	LastInfoUpdated int64
-	SizeInBytes     int64
-	FileMode        os.FileMode
-	OwnerNode       string
+	Basename     string
+	Dir          bool
+	LastModified int64
+	// Hybrid logical clock timestamp of the moment the owner node has obtained this information
+	InfoVersion HLCTimestamp
+	SizeInBytes int64
+	FileMode    os.FileMode
+	OwnerNode   string
+	// Every node having a live replica of the file, or of anything inside the directory.
+	// Not set for individual replicas.
+	Owners []string `json:",omitempty"`
 }
 
 func (n *TreeNode) GetReadonly() *TreeNodeReadonly {
@@ -54,10 +69,39 @@ func (n *TreeNode) GetReadonly() *TreeNodeReadonly {
 		for k, v := range n.childNodes {
 			ro.ChildNodes[k] = v
 		}
+		n.addConflictingReplicas(ro.ChildNodes)
 	}
+	for _, r := range n.replicas {
+		if !r.IsDeleted() {
+			ro.Replicas = append(ro.Replicas, *r)
+		}
+	}
+	primary := n.fileStat.OwnerNode
+	utils.SortSlice(ro.Replicas, func(li, ri interface{}) bool {
+		l, r := li.(FileStat), ri.(FileStat)
+		if (l.OwnerNode == primary) != (r.OwnerNode == primary) {
+			return l.OwnerNode == primary
+		}
+		return l.OwnerNode < r.OwnerNode
+	})
 	return &ro
 }
 
+// Returns a copy of the entry restricted to the replica owned by `owner`,
+// or nil if the owner does not have a live replica.
+func (ro *TreeNodeReadonly) WithOwner(owner string) *TreeNodeReadonly {
+	for _, r := range ro.Replicas {
+		if r.OwnerNode == owner {
+			restricted := *ro
+			restricted.FileStat = r
+			restricted.Owners = []string{owner}
+			restricted.Replicas = []FileStat{r}
+			return &restricted
+		}
+	}
+	return nil
+}
+
 func (n *TreeNode) GetFilestat() *FileStat {
 	n.RLock()
 	defer n.RUnlock()
@@ -87,6 +131,9 @@ func (n *TreeNode) seek(path []string) *TreeNode {
 	entry, ok := n.childNodes[part0]
 	n.RUnlock()
 	if !ok {
+		if len(path) == 1 {
+			return n.seekConflictingReplica(part0)
+		}
 		return nil
 	}
 	if len(path) == 1 {
@@ -0,0 +1,78 @@
+package dfsfat
+
+/*
+* Hybrid logical clock.
+*
+* A timestamp combines wall clock time in milliseconds (upper 48 bits) with a logical counter
+* (lower 16 bits). Timestamps issued by a clock always grow, and every timestamp received from
+* a peer moves the clock forward. Thus information produced after (and with knowledge of)
+* some other information always gets greater timestamp, even if node clocks differ.
+ */
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	hlcLogicalBits = 16
+	// received timestamps this far ahead of local wall clock are reported
+	MaxClockDrift = 1 * time.Minute
+)
+
+type HLCTimestamp int64
+
+func (t HLCTimestamp) WallTime() time.Time {
+	ms := int64(t) >> hlcLogicalBits
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+func (t HLCTimestamp) Logical() int64 {
+	return int64(t) & (1<<hlcLogicalBits - 1)
+}
+
+func (t HLCTimestamp) String() string {
+	return fmt.Sprintf("%s+%d", t.WallTime().UTC().Format("2006-01-02T15:04:05.000"), t.Logical())
+}
+
+func wallTimestamp() HLCTimestamp {
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	return HLCTimestamp(ms << hlcLogicalBits)
+}
+
+type HLClock struct {
+	sync.Mutex
+	last HLCTimestamp
+}
+
+func NewHLClock() *HLClock {
+	return &HLClock{}
+}
+
+// Returns a new timestamp, greater than every timestamp issued or observed before
+func (c *HLClock) Now() HLCTimestamp {
+	c.Lock()
+	defer c.Unlock()
+	wall := wallTimestamp()
+	if wall > c.last {
+		c.last = wall
+	} else {
+		c.last += 1
+	}
+	return c.last
+}
+
+// Moves the clock forward to the timestamp received from a peer
+func (c *HLClock) Observe(t HLCTimestamp) {
+	c.Lock()
+	defer c.Unlock()
+	if t <= c.last {
+		return
+	}
+	if drift := t.WallTime().Sub(time.Now()); drift > MaxClockDrift {
+		log.Printf("WARN: received timestamp %s is %s ahead of local clock", t, drift)
+	}
+	c.last = t
+}
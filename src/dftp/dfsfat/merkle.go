@@ -0,0 +1,80 @@
+package dfsfat
+
+/*
+* Merkle tree of the filesystem tree.
+*
+* Every entry keeps a hash of its replicas (including tombstones) and of the hashes of its
+* children, so two nodes have the same information about a subtree if and only if (barring
+* collisions) the hashes of its root are equal. Peers compare hashes top-down, descending only
+* into children whose hashes differ, to find the replicas one of them has missed.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Hashes of an entry and of its children
+type EntryHashes struct {
+	Hash string
+	// Every replica of the entry itself, including tombstones
+	Replicas []FileStat
+	// Child name -> hash of the child
+	Children map[string]string
+}
+
+// Must be called with n locked, after the children have been recalculated
+func (n *TreeNode) recalculateHash() {
+	h := sha256.New()
+
+	owners := make([]string, 0, len(n.replicas))
+	for owner := range n.replicas {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		r := n.replicas[owner]
+		fmt.Fprintf(h, "replica %q %d %d %d %v %d\n", owner, r.InfoVersion, r.SizeInBytes, r.LastModified, r.Dir, r.FileMode)
+	}
+
+	names := make([]string, 0, len(n.childNodes))
+	for name := range n.childNodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := n.childNodes[name]
+		entry.RLock()
+		fmt.Fprintf(h, "child %q %x\n", name, entry.hash)
+		entry.RUnlock()
+	}
+
+	n.hash = h.Sum(nil)
+}
+
+func (n *TreeNode) Hash() string {
+	n.RLock()
+	defer n.RUnlock()
+	return hex.EncodeToString(n.hash)
+}
+
+func (n *TreeNode) GetHashes() *EntryHashes {
+	n.RLock()
+	defer n.RUnlock()
+	hashes := &EntryHashes{
+		Hash:     hex.EncodeToString(n.hash),
+		Replicas: make([]FileStat, 0, len(n.replicas)),
+		Children: make(map[string]string, len(n.childNodes)),
+	}
+	for _, r := range n.replicas {
+		hashes.Replicas = append(hashes.Replicas, *r)
+	}
+	for name, entry := range n.childNodes {
+		entry.RLock()
+		hashes.Children[name] = hex.EncodeToString(entry.hash)
+		entry.RUnlock()
+	}
+	return hashes
+}
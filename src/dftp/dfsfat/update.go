@@ -6,6 +6,7 @@ package dfsfat
 
 import (
 	"log"
+	"sort"
 	"strings"
 )
 
@@ -17,9 +18,8 @@ type FileAnnouncement struct {
 }
 
 func (fa *FileAnnouncement) ensureInit() {
-	if fa.fullNameParts == nil {
-		fa.fullNameParts = strings.Split(strings.TrimPrefix(fa.FullName, "/"), "/")
-	}
+	// always reset: the same announcement may be applied more than once
+	fa.fullNameParts = strings.Split(strings.TrimPrefix(fa.FullName, "/"), "/")
 	if fa.Deletion {
 		fa.FileStat.SizeInBytes = -1
 	}
@@ -46,6 +46,7 @@ func (n *TreeNode) Update(files []*FileAnnouncement) {
 		fa.ensureInit()
 	}
 	n.update(files)
+	n.recalculate()
 	log.Printf("FAT: update finished (%d items)", len(files))
 }
 
@@ -80,6 +81,10 @@ func (n *TreeNode) update(files []*FileAnnouncement) {
 		n.RLock()
 		entry, ok := n.childNodes[faGroup.name]
 		n.RUnlock()
+		if !ok && onlyDeletions(faGroup.files) {
+			// nothing to delete
+			continue
+		}
 		if !ok {
 			n.Lock()
 			entry, ok = n.childNodes[faGroup.name]
@@ -97,56 +102,168 @@ func (n *TreeNode) update(files []*FileAnnouncement) {
 		nestedFiles := make([]*FileAnnouncement, 0, len(faGroup.files))
 
 		for _, fa := range faGroup.files {
-			if !fa.isLeaf() && !fa.Deletion {
+			if !fa.isLeaf() {
 				fa.nameShift()
 				nestedFiles = append(nestedFiles, fa)
 			} else {
 				entry.Lock()
-				// TODO check if file actually changed
-				if fa.LastInfoUpdated > entry.fileStat.LastInfoUpdated {
-					prevOwner := entry.fileStat.OwnerNode
-					entry.fileStat = fa.FileStat
-					if fa.FileStat.Dir && prevOwner != "" && prevOwner != fa.FileStat.OwnerNode {
-						entry.fileStat.OwnerNode = MultipleNodeOwners
-						// TODO: maybe file moved from one node to another? Need periodic ownership recalculation.
-					}
-				}
+				entry.updateReplica(fa)
 				entry.Unlock()
 			}
 		}
 
 		if len(nestedFiles) > 0 {
-			entry.setAsDir()
+			if !onlyDeletions(nestedFiles) {
+				entry.setAsDir()
+			}
 			entry.update(nestedFiles)
-			entry.recalculateOwner()
+		}
+		entry.recalculate()
+	}
+}
+
+// Must be called with n locked
+func (n *TreeNode) updateReplica(fa *FileAnnouncement) {
+	prev, ok := n.replicas[fa.OwnerNode]
+	if ok && fa.InfoVersion <= prev.InfoVersion {
+		return
+	}
+	if n.replicas == nil {
+		n.replicas = make(map[string]*FileStat)
+	}
+	stat := fa.FileStat // copy
+	stat.Owners = nil
+	n.replicas[fa.OwnerNode] = &stat
+}
+
+func onlyDeletions(files []*FileAnnouncement) bool {
+	for _, fa := range files {
+		if !fa.Deletion {
+			return false
 		}
 	}
+	return true
 }
 
 func (n *TreeNode) setAsDir() {
 	n.Lock()
 	defer n.Unlock()
 	n.fileStat.Dir = true
-	n.fileStat.SizeInBytes = 0
 	if n.childNodes == nil {
 		n.childNodes = make(map[string]*TreeNode)
 	}
 }
 
-func (n *TreeNode) recalculateOwner() {
-	owner := ""
+// Calculates fileStat (and the hash, see merkle.go) from replicas and children:
+//   - the live replica preferred by conflict policy provides file attributes;
+//   - a directory exists as long as it has live replicas or live children;
+//   - Owners is the set of nodes owning live replicas of the entry or of anything inside it.
+func (n *TreeNode) recalculate() {
 	n.Lock()
 	defer n.Unlock()
-	if !n.fileStat.Dir {
-		return
+
+	owners := make(map[string]bool)
+	var winner, tombstone *FileStat
+	for owner, r := range n.replicas {
+		if r.IsDeleted() {
+			if tombstone == nil || r.InfoVersion > tombstone.InfoVersion {
+				tombstone = r
+			}
+			continue
+		}
+		owners[owner] = true
+		if winner == nil || conflictPolicy.Prefer(r, winner) {
+			winner = r
+		}
+	}
+	n.conflicting = nil
+	for owner, r := range n.replicas {
+		if winner != nil && r != winner && !r.IsDeleted() && replicasConflict(r, winner) {
+			n.conflicting = append(n.conflicting, owner)
+		}
 	}
+	sort.Strings(n.conflicting)
+	liveChildren := false
 	for _, e := range n.childNodes {
 		stat := e.GetFilestat()
-		if owner == "" {
-			owner = stat.OwnerNode
-		} else if owner != stat.OwnerNode {
-			owner = MultipleNodeOwners
+		if stat.IsDeleted() {
+			continue
+		}
+		liveChildren = true
+		for _, owner := range stat.Owners {
+			owners[owner] = true
+		}
+	}
+
+	stat := n.fileStat
+	if winner != nil {
+		stat = *winner
+	} else if tombstone != nil {
+		stat = *tombstone
+	}
+	stat.Basename = n.fileStat.Basename
+	if liveChildren {
+		stat.Dir = true
+		stat.SizeInBytes = 0
+	} else if winner == nil && (len(n.replicas) > 0 || len(n.childNodes) > 0) {
+		stat.SizeInBytes = -1
+	} else if stat.Dir && stat.SizeInBytes < 0 {
+		stat.SizeInBytes = 0
+	}
+
+	stat.Owners = make([]string, 0, len(owners))
+	for owner := range owners {
+		stat.Owners = append(stat.Owners, owner)
+	}
+	sort.Strings(stat.Owners)
+	if stat.Dir && len(stat.Owners) > 1 {
+		stat.OwnerNode = MultipleNodeOwners
+	} else if stat.Dir && len(stat.Owners) == 1 {
+		stat.OwnerNode = stat.Owners[0]
+	}
+	n.fileStat = stat
+	n.recalculateHash()
+}
+
+// Prune() marks as deleted every replica owned by `owner` which is not contained in `files`
+// and was updated before `olderThan`. Directory owners are recalculated afterwards.
+// Called upon receiving a full update from `owner`. Returns number of deleted entries.
+func (n *TreeNode) Prune(owner string, files []*FileAnnouncement, olderThan HLCTimestamp) int {
+	present := make(map[string]bool, len(files))
+	for _, fa := range files {
+		if !fa.Deletion {
+			present[strings.Trim(fa.FullName, "/")] = true
+		}
+	}
+	pruned := n.prune(owner, present, olderThan, "")
+	n.recalculate()
+	if pruned > 0 {
+		log.Printf("FAT: pruned %d item(s) owned by %s", pruned, owner)
+	}
+	return pruned
+}
+
+func (n *TreeNode) prune(owner string, present map[string]bool, olderThan HLCTimestamp, basepath string) int {
+	pruned := 0
+	ro := n.GetReadonly()
+	for name, entry := range ro.ChildNodes {
+		path := name
+		if basepath != "" {
+			path = basepath + "/" + name
+		}
+		pruned += entry.prune(owner, present, olderThan, path)
+
+		entry.Lock()
+		r, ok := entry.replicas[owner]
+		if ok && !r.IsDeleted() && !present[path] && r.InfoVersion < olderThan {
+			tombstone := *r
+			tombstone.SizeInBytes = -1
+			tombstone.InfoVersion = olderThan
+			entry.replicas[owner] = &tombstone
+			pruned += 1
 		}
+		entry.Unlock()
+		entry.recalculate()
 	}
-	n.fileStat.OwnerNode = owner
+	return pruned
 }
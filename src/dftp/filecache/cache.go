@@ -0,0 +1,238 @@
+package filecache
+
+/*
+* On-disk LRU cache of remote file contents.
+*
+* Entries are stored as files named after the hash of their key. A file is added to the cache
+* while it is being read: its contents are copied to a temporary file, which becomes an entry
+* once the whole file has been read. Least recently used entries are removed when the total
+* size exceeds the limit.
+ */
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"dftp/utils"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tmpPrefix = "tmp-"
+)
+
+type Cache struct {
+	sync.Mutex
+	Dir     string
+	MaxSize int64
+
+	size    int64
+	lru     *list.List // of *entry, most recently used first
+	entries map[string]*list.Element
+	stats   Stats
+}
+
+type entry struct {
+	name string
+	size int64
+}
+
+type Stats struct {
+	Hits      int64
+	Misses    int64
+	Fills     int64
+	Evictions int64
+	Entries   int
+	Size      int64
+	MaxSize   int64
+}
+
+// Creates a cache in `dir`, picking up entries left from previous runs
+func New(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		Dir:     dir,
+		MaxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// oldest first, so that recently used entries end up at the front
+	utils.SortSlice(infos, func(l, r interface{}) bool {
+		return l.(os.FileInfo).ModTime().Before(r.(os.FileInfo).ModTime())
+	})
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), tmpPrefix) {
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		c.insert(info.Name(), info.Size())
+	}
+	c.evict()
+	log.Printf("Cache: %d entries (%d bytes) in %s", c.lru.Len(), c.size, dir)
+	return c, nil
+}
+
+func entryName(key string) string {
+	h := sha1.Sum([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// Opens the cached contents for `key`, if any.
+// The caller must Close() the returned file afterwards.
+func (c *Cache) Open(key string) (*os.File, bool) {
+	name := entryName(key)
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[name]
+	if ok {
+		f, err := os.Open(filepath.Join(c.Dir, name))
+		if err == nil {
+			c.lru.MoveToFront(el)
+			c.stats.Hits += 1
+			now := time.Now()
+			os.Chtimes(f.Name(), now, now)
+			return f, true
+		}
+		log.Printf("Cache: cannot open entry: %s", err)
+		c.remove(el)
+	}
+	c.stats.Misses += 1
+	return nil, false
+}
+
+// Returns a reader which reads `src` and stores everything read into the cache under `key`.
+// The entry is added only if exactly `size` bytes have been read.
+func (c *Cache) Fill(key string, src io.ReadCloser, size int64) io.ReadCloser {
+	if size > c.MaxSize {
+		return src
+	}
+	tmp, err := ioutil.TempFile(c.Dir, tmpPrefix)
+	if err != nil {
+		log.Printf("Cache: cannot create entry: %s", err)
+		return src
+	}
+	return &fillingReader{
+		cache: c,
+		name:  entryName(key),
+		size:  size,
+		src:   src,
+		tmp:   tmp,
+	}
+}
+
+func (c *Cache) GetStats() Stats {
+	c.Lock()
+	defer c.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Size = c.size
+	stats.MaxSize = c.MaxSize
+	return stats
+}
+
+// Must be called with the mutex held
+func (c *Cache) insert(name string, size int64) {
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+	}
+	c.entries[name] = c.lru.PushFront(&entry{name: name, size: size})
+	c.size += size
+}
+
+// Must be called with the mutex held
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.name)
+	c.size -= e.size
+}
+
+// Removes least recently used entries until the cache fits into MaxSize.
+// Must be called with the mutex held
+func (c *Cache) evict() {
+	for c.size > c.MaxSize && c.lru.Len() > 0 {
+		el := c.lru.Back()
+		e := el.Value.(*entry)
+		// readers of the entry, if any, keep reading the unlinked file
+		if err := os.Remove(filepath.Join(c.Dir, e.name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Cache: cannot remove entry: %s", err)
+		}
+		c.remove(el)
+		c.stats.Evictions += 1
+	}
+}
+
+func (c *Cache) commit(tmpPath string, name string, size int64) {
+	c.Lock()
+	defer c.Unlock()
+	if err := os.Rename(tmpPath, filepath.Join(c.Dir, name)); err != nil {
+		log.Printf("Cache: cannot store entry: %s", err)
+		os.Remove(tmpPath)
+		return
+	}
+	c.insert(name, size)
+	c.stats.Fills += 1
+	c.evict()
+}
+
+type fillingReader struct {
+	cache   *Cache
+	name    string
+	size    int64
+	src     io.ReadCloser
+	tmp     *os.File
+	written int64
+	failed  bool
+	done    bool
+}
+
+func (r *fillingReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 && !r.failed {
+		if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			log.Printf("Cache: cannot write entry: %s", werr)
+			r.failed = true
+		}
+		r.written += int64(n)
+	}
+	if err == io.EOF {
+		r.finish()
+	}
+	return n, err
+}
+
+func (r *fillingReader) Close() error {
+	r.finish()
+	return r.src.Close()
+}
+
+// Stores the entry if the whole file has been read, discards it otherwise
+func (r *fillingReader) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	tmpPath := r.tmp.Name()
+	err := r.tmp.Close()
+	if err != nil || r.failed || r.written != r.size {
+		os.Remove(tmpPath)
+		return
+	}
+	r.cache.commit(tmpPath, r.name, r.size)
+}
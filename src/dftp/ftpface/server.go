@@ -2,15 +2,23 @@ package ftpface
 
 /* Public FTP interface to distributed file system.
 *
-* Read-only.
+* Writes are performed through cluster.Proxy, which routes them to the nodes owning the files.
+* Access to paths is checked against Acl (see auth/acl.go), just as in the HTTP interface.
+*
+* With a TLS certificate, the interface supports FTPS: explicit (AUTH TLS on the regular port,
+* RFC 4217) or implicit (TLS from the start). Passive data connections are encrypted after PROT P
+* (always, in implicit mode); active ones cannot be encrypted and are refused then.
  */
 
 import (
+	"dftp/auth"
 	"dftp/cluster"
 	"dftp/dfsfat"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -23,12 +31,23 @@ var (
 	NotFoundError       = fmt.Errorf("not found")
 	NotAFileError       = fmt.Errorf("not a file")
 	NotADirectoryError  = fmt.Errorf("not a firectory")
+	InvalidOffsetError  = fmt.Errorf("invalid file offset")
 )
 
 type Server struct {
 	DfsRoot   *dfsfat.TreeNode
 	Cluster   *cluster.Cluster
+	Users     *auth.UserDb
+	Acl       *auth.Acl // nil if everything is allowed
 	ftpserver goftp.Server
+
+	// FTPS is enabled if both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLS from the start instead of AUTH TLS
+	ImplicitTLS bool
+	// refuse logins and transfers over unencrypted connections
+	RequireTLS bool
 }
 
 var _ goftp.DriverFactory = &Server{}
@@ -43,12 +62,25 @@ func (s *Server) ServeFtp(addr string) {
 		log.Fatalf("invalid ftp port: %s", err)
 	}
 
-	ftp := goftp.NewServer(&goftp.ServerOpts{
+	opts := &goftp.ServerOpts{
 		Factory: s,
 		Port:    port,
-		Auth:    &Auth{},
-	})
-	log.Printf("FTP public interface listening on %s...", addr)
+		Auth:    &Auth{Users: s.Users},
+	}
+	mode := ""
+	if s.TLSCertFile != "" && s.TLSKeyFile != "" {
+		opts.TLS = true
+		opts.CertFile = s.TLSCertFile
+		opts.KeyFile = s.TLSKeyFile
+		opts.ExplicitFTPS = !s.ImplicitTLS
+		opts.ForceTLS = s.RequireTLS
+		mode = " (explicit FTPS)"
+		if s.ImplicitTLS {
+			mode = " (implicit FTPS)"
+		}
+	}
+	ftp := goftp.NewServer(opts)
+	log.Printf("FTP public interface listening on %s%s...", addr, mode)
 	err = ftp.ListenAndServe()
 	if err != nil {
 		log.Fatalf("ftp: %s", err)
@@ -63,14 +95,24 @@ func (s *Server) NewDriver() (goftp.Driver, error) {
 }
 
 type Auth struct {
+	Users *auth.UserDb
 }
 
 func (a *Auth) CheckPasswd(login, pass string) (bool, error) {
-	return true, nil
+	return a.Users.Authenticate(login, pass, "FTP", ""), nil
+}
+
+func (a *Auth) CheckPasswdFrom(login, pass string, remoteAddr net.Addr) (bool, error) {
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		host = remoteAddr.String()
+	}
+	return a.Users.Authenticate(login, pass, "FTP "+remoteAddr.String(), host), nil
 }
 
 type Driver struct {
 	Server *Server
+	conn   *goftp.Conn
 }
 
 var _ goftp.Driver = &Driver{}
@@ -83,25 +125,48 @@ func (d *Driver) normalizePath(path string) string {
 }
 
 func (d *Driver) Init(conn *goftp.Conn) {
+	d.conn = conn
+}
+
+// User the session is authenticated as
+func (d *Driver) user() string {
+	login := d.conn.LoginUser()
+	if auth.IsAnonymous(login) {
+		return auth.AnonymousUser
+	}
+	return login
+}
+
+// Anonymous users have read-only access; others need write permission
+// on the (normalized) paths and everything under them
+func (d *Driver) checkWritable(paths ...string) error {
+	user := d.user()
+	if user == auth.AnonymousUser {
+		return ReadOnlyAccessError
+	}
+	for _, path := range paths {
+		if !d.Server.Acl.AllowedTree(user, path, auth.WritePermission) {
+			return auth.AccessDeniedError
+		}
+	}
+	return nil
 }
 
 func (d *Driver) Stat(path string) (goftp.FileInfo, error) {
 	path = d.normalizePath(path)
-	entry := d.Server.DfsRoot.Seek(path)
-	if entry == nil {
-		return nil, NotFoundError
+	ro, err := d.seekVisible(path)
+	if err != nil {
+		return nil, err
 	}
-	ro := entry.GetReadonly()
 	return &ro.FileStat, nil
 }
 
 func (d *Driver) ChangeDir(path string) error {
 	path = d.normalizePath(path)
-	entry := d.Server.DfsRoot.Seek(path)
-	if entry == nil {
-		return NotFoundError
+	ro, err := d.seekVisible(path)
+	if err != nil {
+		return err
 	}
-	ro := entry.GetReadonly()
 	if !ro.IsDir() {
 		return NotADirectoryError
 	}
@@ -110,18 +175,21 @@ func (d *Driver) ChangeDir(path string) error {
 
 func (d *Driver) ListDir(path string, callback func(goftp.FileInfo) error) error {
 	path = d.normalizePath(path)
-	entry := d.Server.DfsRoot.Seek(path)
-	if entry == nil {
-		return NotFoundError
+	ro, err := d.seekVisible(path)
+	if err != nil {
+		return err
 	}
-	ro := entry.GetReadonly()
 	if !ro.IsDir() {
 		return NotADirectoryError
 	}
 
-	for _, entry := range ro.ChildNodes {
+	user := d.user()
+	for name, entry := range ro.ChildNodes {
 		entryStat := entry.GetFilestat()
-		if entryStat.IsDeleted() { // file was removed
+		if !d.Server.Cluster.IsVisible(entryStat) { // file was removed or its owner is dead
+			continue
+		}
+		if !d.Server.Acl.Visible(user, filepath.Join(path, name)) {
 			continue
 		}
 		err := callback(entryStat)
@@ -132,45 +200,106 @@ func (d *Driver) ListDir(path string, callback func(goftp.FileInfo) error) error
 	return nil
 }
 
+// Returns the entry at path if it is visible to the user
+func (d *Driver) seekVisible(path string) (*dfsfat.TreeNodeReadonly, error) {
+	entry := d.Server.DfsRoot.Seek(path)
+	if entry == nil || !d.Server.Acl.Visible(d.user(), path) {
+		return nil, NotFoundError
+	}
+	ro := entry.GetReadonly()
+	if path != "" && !d.Server.Cluster.IsVisible(&ro.FileStat) {
+		return nil, NotFoundError
+	}
+	return ro, nil
+}
+
 func (d *Driver) DeleteDir(path string) error {
 	path = d.normalizePath(path)
-	return ReadOnlyAccessError
+	if err := d.checkWritable(path); err != nil {
+		return err
+	}
+	ro, err := d.seekVisible(path)
+	if err != nil {
+		return err
+	}
+	if !ro.IsDir() {
+		return NotADirectoryError
+	}
+	_, err = d.Server.Cluster.Proxy.Remove(path, false, "", d.user(), 0)
+	return err
 }
 
 func (d *Driver) DeleteFile(path string) error {
 	path = d.normalizePath(path)
-	return ReadOnlyAccessError
+	if err := d.checkWritable(path); err != nil {
+		return err
+	}
+	ro, err := d.seekVisible(path)
+	if err != nil {
+		return err
+	}
+	if ro.IsDir() {
+		return NotAFileError
+	}
+	_, err = d.Server.Cluster.Proxy.Remove(path, false, "", d.user(), 0)
+	return err
 }
 
 func (d *Driver) Rename(pathFrom, pathTo string) error {
 	pathFrom = d.normalizePath(pathFrom)
 	pathTo = d.normalizePath(pathTo)
-	return ReadOnlyAccessError
+	if err := d.checkWritable(pathFrom, pathTo); err != nil {
+		return err
+	}
+	_, err := d.Server.Cluster.Proxy.Rename(pathFrom, pathTo, "", d.user(), 0)
+	return err
 }
 
 func (d *Driver) MakeDir(path string) error {
 	path = d.normalizePath(path)
-	return ReadOnlyAccessError
+	if err := d.checkWritable(path); err != nil {
+		return err
+	}
+	_, err := d.Server.Cluster.Proxy.MakeDir(path, "", d.user(), 0)
+	return err
 }
 
 func (d *Driver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
 	path = d.normalizePath(path)
-	if offset > 0 {
-		return 0, nil, NotImplementedError
+	if offset < 0 {
+		return 0, nil, InvalidOffsetError
 	}
-	entry := d.Server.DfsRoot.Seek(path)
-	if entry == nil {
-		return 0, nil, NotFoundError
+	ro, err := d.seekVisible(path)
+	if err != nil {
+		return 0, nil, err
 	}
-	ro := entry.GetReadonly()
 	if ro.IsDir() {
 		return 0, nil, NotAFileError
 	}
-	f, err := d.Server.Cluster.Proxy.OpenRead(path, ro, 0)
-	return ro.FileStat.SizeInBytes, f, err
+	user := d.user()
+	if !d.Server.Acl.Allowed(user, path, auth.ReadPermission) {
+		return 0, nil, auth.AccessDeniedError
+	}
+	if offset == 0 {
+		f, err := d.Server.Cluster.Proxy.OpenRead(path, ro, user, 0)
+		return ro.FileStat.SizeInBytes, f, err
+	}
+	// resumed transfer (REST): the rest of the file must come from the same version of it
+	if offset > ro.FileStat.SizeInBytes {
+		return 0, nil, InvalidOffsetError
+	}
+	f, err := d.Server.Cluster.Proxy.OpenRange(path, ro, offset, user, 0)
+	return ro.FileStat.SizeInBytes - offset, f, err
 }
 
 func (d *Driver) PutFile(path string, data io.Reader, appendData bool) (int64, error) {
 	path = d.normalizePath(path)
-	return 0, NotImplementedError
+	if err := d.checkWritable(path); err != nil {
+		return 0, err
+	}
+	if ro, err := d.seekVisible(path); err == nil && ro.IsDir() {
+		return 0, NotAFileError
+	}
+	n, _, err := d.Server.Cluster.Proxy.WriteFile(path, data, appendData, "", d.user(), 0)
+	return n, err
 }
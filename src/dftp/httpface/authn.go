@@ -0,0 +1,131 @@
+package httpface
+
+/*
+* Authentication of public HTTP requests.
+*
+* Every authenticator of the server looks for credentials of its kind in the request:
+*   - Basic auth (users shared with FTP, see auth.UserDb)
+*   - `Authorization: Bearer <token>` (static API tokens, see auth.TokenDb)
+*   - `user`, `expires` and `signature` query parameters (signed URLs, see auth.UrlSigner)
+* The first one to find them decides. Requests without credentials are anonymous,
+* unless anonymous access is disabled.
+*
+* Requests forwarded by peers are made on behalf of the user in cluster.ForwardedUserHeader,
+* if they are authenticated as coming from a peer (see cluster.IsPeerRequest); otherwise
+* the header is ignored, and the request is authenticated as any other.
+ */
+
+import (
+	"dftp/auth"
+	"dftp/cluster"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	NoCredentialsError      = fmt.Errorf("no credentials")
+	InvalidCredentialsError = fmt.Errorf("invalid credentials")
+	SignedUrlMethodError    = fmt.Errorf("signed URLs can only be used to read")
+)
+
+type Authenticator interface {
+	// Returns the user the request is made by, or NoCredentialsError
+	// if the request carries no credentials of this kind
+	Authenticate(r *http.Request) (string, error)
+}
+
+type BasicAuthenticator struct {
+	Users *auth.UserDb
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (string, error) {
+	login, password, ok := r.BasicAuth()
+	if !ok {
+		return "", NoCredentialsError
+	}
+	if auth.IsAnonymous(login) {
+		return auth.AnonymousUser, nil
+	}
+	if !a.Users.Authenticate(login, password, "HTTP "+r.RemoteAddr, remoteHost(r)) {
+		return "", InvalidCredentialsError
+	}
+	return login, nil
+}
+
+type TokenAuthenticator struct {
+	Tokens *auth.TokenDb
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", NoCredentialsError
+	}
+	login, ok := a.Tokens.Authenticate(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), "HTTP "+r.RemoteAddr)
+	if !ok {
+		return "", InvalidCredentialsError
+	}
+	return login, nil
+}
+
+type SignedUrlAuthenticator struct {
+	Signer *auth.UrlSigner
+}
+
+func (a *SignedUrlAuthenticator) Authenticate(r *http.Request) (string, error) {
+	q := r.URL.Query()
+	if !auth.IsSigned(q) {
+		return "", NoCredentialsError
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return "", SignedUrlMethodError
+	}
+	return a.Signer.Verify(fsPath(r.URL.Path), q)
+}
+
+// Returns the user the request is made by; responds with 401 and returns false
+// if the request cannot be authenticated
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner := r.URL.Query().Get("owner")
+	forwardedUser := r.Header.Get(cluster.ForwardedUserHeader)
+	if owner != "" && forwardedUser != "" && s.Cluster.IsPeerRequest(r) {
+		return forwardedUser, true
+	}
+
+	user := auth.AnonymousUser
+	for _, a := range s.Authenticators {
+		u, err := a.Authenticate(r)
+		if err == NoCredentialsError {
+			continue
+		}
+		if err != nil {
+			log.Printf("HTTP: %s %s from %s refused: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+			unauthorized(w, err)
+			return "", false
+		}
+		user = u
+		break
+	}
+	if user == auth.AnonymousUser && !s.Anonymous {
+		unauthorized(w, fmt.Errorf("authentication required"))
+		return "", false
+	}
+	return user, true
+}
+
+// Returns the address of the client, without the port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func unauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="dftp"`)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
@@ -0,0 +1,92 @@
+package httpface
+
+/*
+* Adapters allowing http.ServeContent to serve DFS files, handling
+* Range, HEAD and conditional requests.
+ */
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Seekable view of a DFS file. The file is (re)opened at the current offset
+// upon the first read after seeking, so ranges are requested from the owner node
+// instead of reading the whole file.
+type rangeReader struct {
+	open    func(offset int64) (io.ReadCloser, error)
+	size    int64
+	offset  int64
+	r       io.ReadCloser
+	openErr error
+}
+
+func (f *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if offset != f.offset && f.r != nil {
+		f.r.Close()
+		f.r = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *rangeReader) Read(p []byte) (int, error) {
+	if f.r == nil {
+		r, err := f.open(f.offset)
+		if err != nil {
+			f.openErr = err
+			return 0, err
+		}
+		f.r = r
+	}
+	n, err := f.r.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *rangeReader) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	return f.r.Close()
+}
+
+// Delays sending the response header until the first byte of the body,
+// so that the response can still be replaced with an error if the file cannot be opened.
+type delayedHeaderWriter struct {
+	http.ResponseWriter
+	status     int
+	headerSent bool
+}
+
+func (w *delayedHeaderWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *delayedHeaderWriter) Write(p []byte) (int, error) {
+	w.sendHeader()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *delayedHeaderWriter) sendHeader() {
+	if w.headerSent {
+		return
+	}
+	w.headerSent = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
@@ -5,9 +5,13 @@ package httpface
 * Functions:
 *   - directory browser
 *   - file downloader
+*
+* Requests are authenticated (see authn.go), and access to paths is checked against Acl
+* (see auth/acl.go).
  */
 
 import (
+	"dftp/auth"
 	"dftp/cluster"
 	"dftp/dfsfat"
 	"dftp/httputils"
@@ -27,7 +31,15 @@ import (
 type Server struct {
 	DfsRoot *dfsfat.TreeNode
 	Cluster *cluster.Cluster
-	mux     *http.ServeMux
+	// nil if everything is allowed
+	Acl            *auth.Acl
+	Authenticators []Authenticator
+	// allow requests without credentials
+	Anonymous bool
+	// HTTPS is enabled if both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	mux         *http.ServeMux
 }
 
 func (s *Server) ServeHttp(addr string) {
@@ -35,8 +47,20 @@ func (s *Server) ServeHttp(addr string) {
 	httputils.HandleFunc(s.mux, "/", s.Index)
 	httputils.HandleFunc(s.mux, "/fs/", s.Fs)
 	httputils.HandleFunc(s.mux, "/find/", s.Find)
-	log.Printf("HTTP public interface listening on %s...", addr)
-	if err := http.ListenAndServe(addr, s.mux); err != nil {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: s.mux,
+	}
+	var err error
+	if s.TLSCertFile != "" && s.TLSKeyFile != "" {
+		server.TLSConfig = s.Cluster.PublicTLSConfig()
+		log.Printf("HTTPS public interface listening on %s...", addr)
+		err = server.ListenAndServeTLS(s.TLSCertFile, s.TLSKeyFile)
+	} else {
+		log.Printf("HTTP public interface listening on %s...", addr)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatalf("http: %s", err)
 	}
 }
@@ -47,27 +71,69 @@ func (s *Server) Index(w http.ResponseWriter, r *http.Request) {
 
 // Display full distributed filesystem listing as plain text
 func (s *Server) Find(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	s.DfsRoot.Walk(func(path string, info os.FileInfo, _ error) error {
+		if !s.Cluster.IsVisible(info.(*dfsfat.FileStat)) || !s.Acl.Visible(user, path) {
+			return filepath.SkipDir
+		}
 		fmt.Fprintf(w, "/%s\r\n", path)
 		return nil
 	})
 }
 
-// Display directory listing or serve a single file
+// Display directory listing or serve a single file; modify files (see write.go)
 func (s *Server) Fs(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		s.PutFile(w, r, user)
+		return
+	case "POST":
+		s.PostFiles(w, r, user)
+		return
+	case "DELETE":
+		s.Delete(w, r, user)
+		return
+	case "MKCOL":
+		s.MakeDir(w, r, user)
+		return
+	case "MOVE":
+		s.Move(w, r, user)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
 	path := strings.TrimPrefix(r.URL.Path, "/fs/")
 	path = strings.TrimSuffix(path, "/")
 	path = strings.TrimPrefix(path, "/")
 	entry := s.DfsRoot.Seek(path)
-	if entry == nil {
+	if entry == nil || !s.Acl.Visible(user, path) {
 		http.Error(w, fmt.Sprintf("`%s` not found in DFS", path), 404)
 		return
 	}
 	ro := entry.GetReadonly()
+	if path != "" && !s.Cluster.IsVisible(&ro.FileStat) {
+		http.Error(w, fmt.Sprintf("`%s` not found in DFS", path), 404)
+		return
+	}
 
 	if !ro.IsDir() {
-		s.ServeFile(w, r, path, ro)
+		if !s.Acl.Allowed(user, path, auth.ReadPermission) {
+			log.Printf("HTTP: user `%s` may not read %s", user, path)
+			http.Error(w, fmt.Sprintf("%s: %s", path, auth.AccessDeniedError), http.StatusForbidden)
+			return
+		}
+		s.ServeFile(w, r, path, ro, user)
 		return
 	}
 
@@ -109,7 +175,10 @@ func (s *Server) Fs(w http.ResponseWriter, r *http.Request) {
 		name := eee.Name
 		entry := eee.Entry
 		entryStat := entry.GetFilestat()
-		if entryStat.IsDeleted() { // file was removed
+		if !s.Cluster.IsVisible(entryStat) { // file was removed or its owner is dead
+			continue
+		}
+		if !s.Acl.Visible(user, filepath.Join(path, eee.Name)) {
 			continue
 		}
 		if entryStat.IsDir() {
@@ -135,21 +204,34 @@ func (s *Server) Fs(w http.ResponseWriter, r *http.Request) {
 			txtLink = "   "
 		}
 
-		fmt.Fprintf(w, `<a href="%s">%s</a>%s%20s%20s %s   %s`+"\r\n", name, displayName, spaces, dt, sz, txtLink, entryStat.OwnerNode)
+		owners := entryStat.OwnerNode
+		if len(entryStat.Owners) > 0 {
+			owners = strings.Join(entryStat.Owners, ",")
+		}
+		fmt.Fprintf(w, `<a href="%s">%s</a>%s%20s%20s %s   %s`+"\r\n", name, displayName, spaces, dt, sz, txtLink, owners)
 	}
 	fmt.Fprintf(w, `</pre><hr/></body></html>`)
 }
 
-func (s *Server) ServeFile(w http.ResponseWriter, r *http.Request, path string, entry *dfsfat.TreeNodeReadonly) {
+func (s *Server) ServeFile(w http.ResponseWriter, r *http.Request, path string, entry *dfsfat.TreeNodeReadonly, user string) {
 	redirN, err := strconv.Atoi(r.FormValue("redirN"))
 	if err != nil {
 		redirN = 0
 	}
+	if owner := r.FormValue("owner"); owner != "" {
+		// request for a particular replica
+		entry = entry.WithOwner(owner)
+		if entry == nil {
+			http.Error(w, fmt.Sprintf("`%s` has no replica on %s", path, owner), 404)
+			return
+		}
+	}
 
-	f, err := s.Cluster.Proxy.OpenRead(path, entry, redirN)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	f := &rangeReader{
+		open: func(offset int64) (io.ReadCloser, error) {
+			return s.Cluster.Proxy.OpenRange(path, entry, offset, user, redirN)
+		},
+		size: entry.SizeInBytes,
 	}
 	defer f.Close()
 
@@ -157,12 +239,26 @@ func (s *Server) ServeFile(w http.ResponseWriter, r *http.Request, path string,
 	if r.FormValue("format") == "txt" {
 		ctype = "text/plain; charset=utf-8"
 	}
-	if ctype != "" {
-		w.Header().Set("Content-Type", ctype)
+	if ctype == "" {
+		// otherwise ServeContent sniffs the content, opening the file twice
+		ctype = "application/octet-stream"
 	}
-	_, err = io.Copy(w, f)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	w.Header().Set("Content-Type", ctype)
+	// identical replicas have the same tag, whichever node serves them
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, entry.LastModified, entry.SizeInBytes))
+
+	dw := &delayedHeaderWriter{ResponseWriter: w}
+	http.ServeContent(dw, r, filepath.Base(path), time.Unix(entry.LastModified, 0), f)
+	if f.openErr != nil {
+		if dw.headerSent {
+			log.Printf("ERROR: serving %s: %s", path, f.openErr)
+			return
+		}
+		for _, h := range []string{"Content-Length", "Content-Range", "ETag", "Last-Modified", "Accept-Ranges"} {
+			w.Header().Del(h)
+		}
+		http.Error(w, f.openErr.Error(), 500)
+		return
 	}
-	return
+	dw.sendHeader()
 }
@@ -0,0 +1,210 @@
+package httpface
+
+/*
+* Write operations of the public HTTP interface:
+*   - PUT /fs/<path>: upload file contents (`append=true` to append)
+*   - POST /fs/<dir>/: upload files from multipart/form-data
+*   - DELETE /fs/<path>: remove file or directory (`recursive=true` for non-empty directories)
+*   - MKCOL /fs/<path>: create directory
+*   - MOVE /fs/<path> with Destination header: rename file or directory
+*
+* Every operation responds with a JSON list of resulting file announcements.
+* The user must have write permission on the paths (on every path under them, for directories).
+ */
+
+import (
+	"dftp/auth"
+	"dftp/cluster"
+	"dftp/dfsfat"
+	"dftp/localfs"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Path inside DFS the request refers to
+func fsPath(urlPath string) string {
+	path := strings.TrimPrefix(urlPath, "/fs/")
+	return strings.Trim(filepath.Clean("/"+path), "/")
+}
+
+// Parameters set by nodes forwarding the request: the node which must perform it, and redirect count
+func forwardingParams(r *http.Request) (string, int) {
+	q := r.URL.Query()
+	redirN, err := strconv.Atoi(q.Get("redirN"))
+	if err != nil {
+		redirN = 0
+	}
+	return q.Get("owner"), redirN
+}
+
+// Returns an error unless the user may modify the path and everything under it
+func (s *Server) checkWritable(user string, path string) error {
+	if !s.Acl.AllowedTree(user, path, auth.WritePermission) {
+		return auth.AccessDeniedError
+	}
+	return nil
+}
+
+func (s *Server) PutFile(w http.ResponseWriter, r *http.Request, user string) {
+	path := fsPath(r.URL.Path)
+	if path == "" {
+		http.Error(w, "file path required", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkWritable(user, path); err != nil {
+		writeError(w, path, err)
+		return
+	}
+	owner, redirN := forwardingParams(r)
+	appendData := r.URL.Query().Get("append") == "true"
+	_, files, err := s.Cluster.Proxy.WriteFile(path, r.Body, appendData, owner, user, redirN)
+	if err != nil {
+		writeError(w, path, err)
+		return
+	}
+	log.Printf("HTTP: uploaded %s", path)
+	writeResult(w, http.StatusCreated, files)
+}
+
+// Multipart uploads into a directory; other POST requests are treated as PUT
+func (s *Server) PostFiles(w http.ResponseWriter, r *http.Request, user string) {
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ctype != "multipart/form-data" {
+		s.PutFile(w, r, user)
+		return
+	}
+	dir := fsPath(r.URL.Path)
+	owner, redirN := forwardingParams(r)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allFiles := make([]*dfsfat.FileAnnouncement, 0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// files written so far are kept
+			http.Error(w, fmt.Sprintf("malformed multipart body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		path := filepath.Join(dir, filepath.Base(part.FileName()))
+		if err := s.checkWritable(user, path); err != nil {
+			writeError(w, path, err)
+			return
+		}
+		_, files, err := s.Cluster.Proxy.WriteFile(path, part, false, owner, user, redirN)
+		if err != nil {
+			writeError(w, path, err)
+			return
+		}
+		log.Printf("HTTP: uploaded %s", path)
+		allFiles = append(allFiles, files...)
+	}
+	writeResult(w, http.StatusCreated, allFiles)
+}
+
+func (s *Server) Delete(w http.ResponseWriter, r *http.Request, user string) {
+	path := fsPath(r.URL.Path)
+	if err := s.checkWritable(user, path); err != nil {
+		writeError(w, path, err)
+		return
+	}
+	owner, redirN := forwardingParams(r)
+	recursive := r.URL.Query().Get("recursive") == "true"
+	files, err := s.Cluster.Proxy.Remove(path, recursive, owner, user, redirN)
+	if err != nil {
+		writeError(w, path, err)
+		return
+	}
+	log.Printf("HTTP: removed %s", path)
+	writeResult(w, http.StatusOK, files)
+}
+
+func (s *Server) MakeDir(w http.ResponseWriter, r *http.Request, user string) {
+	path := fsPath(r.URL.Path)
+	if err := s.checkWritable(user, path); err != nil {
+		writeError(w, path, err)
+		return
+	}
+	owner, redirN := forwardingParams(r)
+	files, err := s.Cluster.Proxy.MakeDir(path, owner, user, redirN)
+	if err != nil {
+		writeError(w, path, err)
+		return
+	}
+	log.Printf("HTTP: created directory %s", path)
+	writeResult(w, http.StatusCreated, files)
+}
+
+func (s *Server) Move(w http.ResponseWriter, r *http.Request, user string) {
+	path := fsPath(r.URL.Path)
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || !strings.HasPrefix(dest.Path, "/fs/") {
+		http.Error(w, "Destination header must contain /fs/<new path>", http.StatusBadRequest)
+		return
+	}
+	to := fsPath(dest.Path)
+	if path == "" || to == "" {
+		http.Error(w, "cannot move the root directory", http.StatusBadRequest)
+		return
+	}
+	for _, p := range []string{path, to} {
+		if err := s.checkWritable(user, p); err != nil {
+			writeError(w, p, err)
+			return
+		}
+	}
+	owner, redirN := forwardingParams(r)
+	files, err := s.Cluster.Proxy.Rename(path, to, owner, user, redirN)
+	if err != nil {
+		writeError(w, path, err)
+		return
+	}
+	log.Printf("HTTP: moved %s to %s", path, to)
+	writeResult(w, http.StatusOK, files)
+}
+
+func writeResult(w http.ResponseWriter, status int, files []*dfsfat.FileAnnouncement) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(files)
+}
+
+func writeError(w http.ResponseWriter, path string, err error) {
+	status := 500
+	switch {
+	case os.IsNotExist(err) || err == cluster.PathNotFoundError:
+		status = http.StatusNotFound
+	case os.IsExist(err), errors.Is(err, syscall.ENOTEMPTY):
+		status = http.StatusConflict
+	case os.IsPermission(err), err == auth.AccessDeniedError, err == localfs.OutsideMountPointError, err == localfs.LocalRootError, err == cluster.NoWritableNodeError:
+		status = http.StatusForbidden
+	case err == cluster.NodeUnavailableError:
+		status = http.StatusServiceUnavailable
+	}
+	log.Printf("HTTP: cannot modify %s: %s", path, err)
+	if ferr, ok := err.(*cluster.ForwardedError); ok {
+		// already describes the path
+		http.Error(w, ferr.Message, ferr.StatusCode)
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s: %s", path, err), status)
+}
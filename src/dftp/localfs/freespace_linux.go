@@ -0,0 +1,14 @@
+package localfs
+
+import (
+	"syscall"
+)
+
+// Returns the number of bytes available for writing under the local root, or -1 if unknown
+func (fs *LocalFs) FreeSpace() int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(fs.LocalRoot, &st); err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
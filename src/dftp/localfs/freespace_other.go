@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package localfs
+
+// Returns the number of bytes available for writing under the local root, or -1 if unknown
+func (fs *LocalFs) FreeSpace() int64 {
+	return -1
+}
@@ -7,7 +7,6 @@ package localfs
 import (
 	"dftp/dfsfat"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,10 +18,23 @@ type LocalFs struct {
 	DfsMountPoint string
 	DfsRoot       *dfsfat.TreeNode
 	MyNodeName    string
+	// Stamps versions of local file announcements
+	Clock *dfsfat.HLClock
 
+	// Called with every batch of local changes after it has been applied to DfsRoot
+	OnChange func(files []*dfsfat.FileAnnouncement)
+	// Called after the first full scan has finished
+	OnScanned func()
+
+	scanMutex        sync.Mutex
 	lastScanMutex    sync.RWMutex
 	LastFullScan     []*dfsfat.FileAnnouncement
 	LastFullScanTime int64
+	// Version of the latest information included into LastFullScan
+	LastFullScanVersion dfsfat.HLCTimestamp
+	// LastFullScan indexed by FullName; modified only with scanMutex held
+	localFiles map[string]*dfsfat.FileAnnouncement
+	scanned    bool
 }
 
 func NewLocalFs(localRoot string, dfsMountPoint string, dfsRoot *dfsfat.TreeNode, myNodeName string) *LocalFs {
@@ -31,6 +43,7 @@ func NewLocalFs(localRoot string, dfsMountPoint string, dfsRoot *dfsfat.TreeNode
 		DfsMountPoint: dfsMountPoint,
 		DfsRoot:       dfsRoot,
 		MyNodeName:    myNodeName,
+		Clock:         dfsfat.NewHLClock(),
 	}
 	if strings.HasPrefix(s.DfsMountPoint, "/") {
 		s.DfsMountPoint = strings.TrimPrefix(s.DfsMountPoint, "/")
@@ -41,17 +54,24 @@ func NewLocalFs(localRoot string, dfsMountPoint string, dfsRoot *dfsfat.TreeNode
 	return s
 }
 
-func (fs *LocalFs) GetLastFullScan() ([]*dfsfat.FileAnnouncement, int64) {
+// Returns false until the first full scan has finished
+func (fs *LocalFs) IsScanned() bool {
+	fs.lastScanMutex.RLock()
+	defer fs.lastScanMutex.RUnlock()
+	return fs.scanned
+}
+
+func (fs *LocalFs) GetLastFullScan() ([]*dfsfat.FileAnnouncement, int64, dfsfat.HLCTimestamp) {
 	fs.lastScanMutex.RLock()
 	defer fs.lastScanMutex.RUnlock()
-	return fs.LastFullScan, fs.LastFullScanTime
+	return fs.LastFullScan, fs.LastFullScanTime, fs.LastFullScanVersion
 }
 
 var (
 	LocalFileNotFoundError = fmt.Errorf("local file not found")
 )
 
-func (fs *LocalFs) OpenRead(dfsPath string) (io.ReadCloser, error) {
+func (fs *LocalFs) OpenRead(dfsPath string) (*os.File, error) {
 	if fs.DfsMountPoint != "" {
 		if !strings.HasPrefix(dfsPath, fs.DfsMountPoint) {
 			return nil, LocalFileNotFoundError
@@ -5,52 +5,290 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
 
+// Full scan performed at startup. Populates LastFullScan and the DFS tree.
+// Local entries which are no longer present (e.g. loaded from a snapshot) are pruned.
 func (s *LocalFs) ScanOnce() {
-	files := make([]*dfsfat.FileAnnouncement, 0)
-
-	scanT := time.Now().Unix()
+	s.scanMutex.Lock()
+	defer s.scanMutex.Unlock()
 
 	log.Printf("Scanner: starting local scan...")
+	files, version, err := s.scan()
+	log.Printf("Scanner: local scan finished, %d file(s) found", len(files))
+	if err != nil {
+		log.Fatalf("Scanner: scan error: %s", err)
+	}
+
+	s.setLastFullScan(files, version)
+	s.DfsRoot.Update(files)
+	s.DfsRoot.Prune(s.MyNodeName, files, version)
+
+	s.lastScanMutex.Lock()
+	firstScan := !s.scanned
+	s.scanned = true
+	s.lastScanMutex.Unlock()
+	if firstScan && s.OnScanned != nil {
+		s.OnScanned()
+	}
+}
+
+// Rescan compares a fresh scan with LastFullScan, applies the difference
+// to the DFS tree and hands it to OnChange.
+func (s *LocalFs) Rescan() {
+	s.scanMutex.Lock()
+	defer s.scanMutex.Unlock()
+	if s.localFiles == nil {
+		// the first full scan has not started yet
+		return
+	}
+
+	log.Printf("Scanner: starting local rescan...")
+	files, version, err := s.scan()
+	if err != nil {
+		log.Printf("Scanner: rescan error: %s", err)
+		return
+	}
+
+	files, changes := diffScans(s.localFiles, files, version)
+	log.Printf("Scanner: local rescan finished, %d file(s) found, %d change(s)", len(files), len(changes))
+
+	s.setLastFullScan(files, version)
+	s.announceChanges(changes)
+}
+
+// Must be called with scanMutex held.
+func (s *LocalFs) setLastFullScan(files []*dfsfat.FileAnnouncement, version dfsfat.HLCTimestamp) {
+	localFiles := make(map[string]*dfsfat.FileAnnouncement, len(files))
+	for _, fa := range files {
+		localFiles[fa.FullName] = fa
+	}
+	s.localFiles = localFiles
+
+	s.lastScanMutex.Lock()
+	s.LastFullScan = files
+	s.LastFullScanTime = version.WallTime().Unix()
+	s.LastFullScanVersion = version
+	s.lastScanMutex.Unlock()
+}
+
+// Amends LastFullScan with a batch of changes and announces them.
+// Must be called with scanMutex held.
+func (s *LocalFs) commitChanges(changes []*dfsfat.FileAnnouncement) {
+	if len(changes) == 0 {
+		return
+	}
+	for _, fa := range changes {
+		if fa.Deletion {
+			delete(s.localFiles, fa.FullName)
+		} else {
+			s.localFiles[fa.FullName] = fa
+		}
+	}
+	files := make([]*dfsfat.FileAnnouncement, 0, len(s.localFiles))
+	for _, fa := range s.localFiles {
+		files = append(files, fa)
+	}
+
+	s.lastScanMutex.Lock()
+	s.LastFullScan = files
+	for _, fa := range changes {
+		if fa.InfoVersion > s.LastFullScanVersion {
+			s.LastFullScanVersion = fa.InfoVersion
+		}
+	}
+	s.lastScanMutex.Unlock()
+
+	s.announceChanges(changes)
+}
+
+func (s *LocalFs) announceChanges(changes []*dfsfat.FileAnnouncement) {
+	if len(changes) == 0 {
+		return
+	}
+	s.DfsRoot.Update(changes)
+	if s.OnChange != nil {
+		s.OnChange(changes)
+	}
+}
+
+func (s *LocalFs) StartPeriodicRescan(period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	go func() {
+		for _ = range time.NewTicker(period).C {
+			s.Rescan()
+		}
+	}()
+}
+
+func (s *LocalFs) scan() ([]*dfsfat.FileAnnouncement, dfsfat.HLCTimestamp, error) {
+	files := make([]*dfsfat.FileAnnouncement, 0)
+
+	version := s.Clock.Now()
 
 	err := filepath.Walk(s.LocalRoot, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+		if err != nil || isUploadTemp(path) {
 			return nil
 		}
-		fa := &dfsfat.FileAnnouncement{
-			FullName: path,
-			Deletion: false,
-		}
-		fa.OwnerNode = s.MyNodeName
-		fa.Dir = info.IsDir()
-		fa.FileMode = info.Mode()
-		fa.Basename = info.Name()
-		fa.LastModified = info.ModTime().Unix()
-		if !info.IsDir() {
-			fa.SizeInBytes = info.Size()
-		}
-		fa.LastInfoUpdated = scanT
-		fa.FullName = strings.TrimPrefix(path, s.LocalRoot)
-		fa.FullName = filepath.Join(s.DfsMountPoint, fa.FullName)
+		fa := s.makeAnnouncement(path, info, version)
 		if fa.FullName != "" {
 			files = append(files, fa)
 		}
 		return nil
 	})
-	log.Printf("Scanner: local scan finished, %d file(s) found", len(files))
-	if err != nil {
-		log.Fatalf("Scanner: scan error: %s", err)
-	} else {
-		s.lastScanMutex.Lock()
-		s.LastFullScan = files
-		s.LastFullScanTime = scanT
-		s.lastScanMutex.Unlock()
+	return files, version, err
+}
+
+func (s *LocalFs) makeAnnouncement(path string, info os.FileInfo, version dfsfat.HLCTimestamp) *dfsfat.FileAnnouncement {
+	fa := &dfsfat.FileAnnouncement{
+		FullName: path,
+		Deletion: false,
+	}
+	fa.OwnerNode = s.MyNodeName
+	fa.Dir = info.IsDir()
+	fa.FileMode = info.Mode()
+	fa.Basename = info.Name()
+	fa.LastModified = info.ModTime().Unix()
+	if !info.IsDir() {
+		fa.SizeInBytes = info.Size()
+	}
+	fa.InfoVersion = version
+	fa.FullName = s.dfsName(path)
+	return fa
+}
+
+// Converts local filename into a path inside DFS
+func (s *LocalFs) dfsName(path string) string {
+	name := strings.TrimPrefix(path, s.LocalRoot)
+	return filepath.Join(s.DfsMountPoint, name)
+}
+
+func makeDeletion(prev *dfsfat.FileAnnouncement, version dfsfat.HLCTimestamp) *dfsfat.FileAnnouncement {
+	fa := &dfsfat.FileAnnouncement{
+		FullName: prev.FullName,
+		Deletion: true,
+	}
+	fa.OwnerNode = prev.OwnerNode
+	fa.Dir = prev.Dir
+	fa.FileMode = prev.FileMode
+	fa.Basename = prev.Basename
+	fa.LastModified = prev.LastModified
+	fa.InfoVersion = version
+	return fa
+}
+
+// Returns the new list of local files and the list of changes relative to prev.
+// Unchanged files keep their previous announcements, so that InfoVersion
+// reflects the moment their information actually changed.
+func diffScans(prev map[string]*dfsfat.FileAnnouncement, cur []*dfsfat.FileAnnouncement, version dfsfat.HLCTimestamp) ([]*dfsfat.FileAnnouncement, []*dfsfat.FileAnnouncement) {
+	prevByName := make(map[string]*dfsfat.FileAnnouncement, len(prev))
+	for name, fa := range prev {
+		prevByName[name] = fa
+	}
+
+	files := make([]*dfsfat.FileAnnouncement, 0, len(cur))
+	changes := make([]*dfsfat.FileAnnouncement, 0)
+	for _, fa := range cur {
+		old, ok := prevByName[fa.FullName]
+		if ok {
+			delete(prevByName, fa.FullName)
+			if !fileChanged(old, fa) {
+				files = append(files, old)
+				continue
+			}
+		}
+		files = append(files, fa)
+		changes = append(changes, fa)
+	}
+	for _, old := range prevByName {
+		changes = append(changes, makeDeletion(old, version))
+	}
+	return files, changes
+}
+
+func fileChanged(a, b *dfsfat.FileAnnouncement) bool {
+	return a.Dir != b.Dir ||
+		a.SizeInBytes != b.SizeInBytes ||
+		a.LastModified != b.LastModified ||
+		a.FileMode != b.FileMode
+}
+
+// Rescans only the given local filenames (and, for directories which were not
+// known before, their contents), announcing the differences. Returns the announced changes.
+func (s *LocalFs) RefreshPaths(paths []string) []*dfsfat.FileAnnouncement {
+	s.scanMutex.Lock()
+	defer s.scanMutex.Unlock()
+	if s.localFiles == nil {
+		// the first full scan has not started yet, and will find the changes
+		return nil
+	}
+
+	version := s.Clock.Now()
+	sort.Strings(paths)
 
-		s.DfsRoot.Update(files)
+	seen := make(map[string]bool)
+	changes := make([]*dfsfat.FileAnnouncement, 0)
+	addChange := func(fa *dfsfat.FileAnnouncement) {
+		if !seen[fa.FullName] {
+			seen[fa.FullName] = true
+			changes = append(changes, fa)
+		}
+	}
+
+	for _, path := range paths {
+		if !strings.HasPrefix(path, s.LocalRoot) || isUploadTemp(path) {
+			continue
+		}
+		name := s.dfsName(path)
+		if name == s.DfsMountPoint {
+			// local root itself
+			continue
+		}
+		old, known := s.localFiles[name]
+		info, err := os.Lstat(path)
+		if err != nil {
+			if !known {
+				continue
+			}
+			addChange(makeDeletion(old, version))
+			if old.Dir {
+				prefix := name + "/"
+				for n, fa := range s.localFiles {
+					if strings.HasPrefix(n, prefix) {
+						addChange(makeDeletion(fa, version))
+					}
+				}
+			}
+			continue
+		}
+		if info.IsDir() && (!known || !old.Dir) {
+			// new or moved-in directory: pick up everything inside
+			filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+				if err != nil || isUploadTemp(path) {
+					return nil
+				}
+				fa := s.makeAnnouncement(path, info, version)
+				if prev, ok := s.localFiles[fa.FullName]; !ok || fileChanged(prev, fa) {
+					addChange(fa)
+				}
+				return nil
+			})
+			continue
+		}
+		fa := s.makeAnnouncement(path, info, version)
+		if !known || fileChanged(old, fa) {
+			addChange(fa)
+		}
+	}
 
-		// TODO: notify peers if partial update is available
+	if len(changes) > 0 {
+		log.Printf("Scanner: %d change(s) in %d refreshed path(s)", len(changes), len(paths))
 	}
+	s.commitChanges(changes)
+	return changes
 }
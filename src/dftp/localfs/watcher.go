@@ -0,0 +1,107 @@
+package localfs
+
+/*
+* Live monitoring of local filesystem changes.
+*
+* A platform-specific backend (inotify on Linux) reports local filenames which may have changed.
+* The watcher coalesces them, waits until the burst of events settles down, and then
+* rescans only the affected paths (see RefreshPaths).
+*
+* If the backend loses events (e.g. its queue overflows or watch descriptors are exhausted),
+* the watcher falls back to full rescans.
+ */
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// a batch is flushed after this much time without new events...
+	WatcherDebounce = 1 * time.Second
+	// ...or after this much time since its first event, whichever comes first
+	WatcherMaxDelay = 5 * time.Second
+	// period of full rescans after the backend ran out of watch descriptors
+	WatcherFallbackRescanPeriod = 1 * time.Minute
+)
+
+var (
+	WatcherNotSupportedError = fmt.Errorf("filesystem watching is not supported on this platform")
+)
+
+type watcherEvent struct {
+	path     string
+	overflow bool // some events were lost; rescan everything
+	degraded bool // backend cannot watch the whole tree anymore
+}
+
+type Watcher struct {
+	fs     *LocalFs
+	events chan watcherEvent
+}
+
+// StartWatcher starts monitoring LocalRoot for changes.
+// Returns an error if the platform backend cannot be initialized.
+func (s *LocalFs) StartWatcher() error {
+	w := &Watcher{
+		fs:     s,
+		events: make(chan watcherEvent, 1024),
+	}
+	// the backend reports events while adding the initial watches
+	go w.loop()
+	err := startWatcherBackend(s.LocalRoot, w.events)
+	if err != nil {
+		return err
+	}
+	log.Printf("Watcher: monitoring %s for changes", s.LocalRoot)
+	return nil
+}
+
+func (w *Watcher) loop() {
+	pending := make(map[string]bool)
+	var firstEventT time.Time
+	timer := time.NewTimer(WatcherDebounce)
+	timer.Stop()
+	degraded := false
+
+	for {
+		select {
+		case ev := <-w.events:
+			if ev.degraded && !degraded {
+				degraded = true
+				log.Printf("Watcher: WARN: cannot watch the whole tree, falling back to full rescans every %s", WatcherFallbackRescanPeriod)
+				w.fs.StartPeriodicRescan(WatcherFallbackRescanPeriod)
+			}
+			if ev.overflow {
+				log.Printf("Watcher: WARN: event queue overflow, scheduling full rescan")
+				pending = make(map[string]bool)
+				timer.Stop()
+				go w.fs.Rescan()
+				continue
+			}
+			if ev.path == "" {
+				continue
+			}
+			if len(pending) == 0 {
+				firstEventT = time.Now()
+			}
+			pending[ev.path] = true
+			delay := WatcherDebounce
+			if left := WatcherMaxDelay - time.Since(firstEventT); left < delay {
+				delay = left
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			if len(pending) == 0 {
+				continue
+			}
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			pending = make(map[string]bool)
+			w.fs.RefreshPaths(paths)
+		}
+	}
+}
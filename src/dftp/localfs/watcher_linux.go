@@ -0,0 +1,149 @@
+package localfs
+
+/*
+* inotify backend for Watcher.
+*
+* inotify is not recursive, so every directory under the local root gets its own watch.
+* Watches are added for directories created or moved into the tree, and removed for
+* directories moved away.
+ */
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	inotifyWatchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+		syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DONT_FOLLOW
+)
+
+type inotifyBackend struct {
+	sync.Mutex
+	fd      int
+	paths   map[int32]string
+	watches map[string]int32
+	events  chan<- watcherEvent
+	// watch descriptors have run out; reported once
+	degraded bool
+}
+
+func startWatcherBackend(root string, events chan<- watcherEvent) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	b := &inotifyBackend{
+		fd:      fd,
+		paths:   make(map[int32]string),
+		watches: make(map[string]int32),
+		events:  events,
+	}
+	b.addTree(strings.TrimSuffix(root, "/"))
+	go b.readLoop()
+	return nil
+}
+
+// Adds watches for dir and every directory beneath it
+func (b *inotifyBackend) addTree(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(b.fd, path, inotifyWatchMask)
+		if err != nil {
+			if err == syscall.ENOSPC {
+				// out of watch descriptors (see /proc/sys/fs/inotify/max_user_watches);
+				// the rest of the tree would fail too
+				b.Lock()
+				report := !b.degraded
+				b.degraded = true
+				b.Unlock()
+				if report {
+					b.events <- watcherEvent{degraded: true}
+				}
+				return filepath.SkipAll
+			}
+			log.Printf("Watcher: cannot watch %s: %s", path, err)
+			return nil
+		}
+		b.Lock()
+		b.paths[int32(wd)] = path
+		b.watches[path] = int32(wd)
+		b.Unlock()
+		return nil
+	})
+}
+
+// Removes watches for dir and every directory beneath it
+func (b *inotifyBackend) removeTree(dir string) {
+	prefix := dir + "/"
+	b.Lock()
+	defer b.Unlock()
+	for path, wd := range b.watches {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			syscall.InotifyRmWatch(b.fd, uint32(wd))
+			delete(b.watches, path)
+			delete(b.paths, wd)
+		}
+	}
+}
+
+func (b *inotifyBackend) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(b.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Printf("Watcher: ERROR: reading inotify events: %s", err)
+			b.events <- watcherEvent{overflow: true, degraded: true}
+			return
+		}
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+			offset = nameStart + int(raw.Len)
+			b.handleEvent(raw.Wd, raw.Mask, name)
+		}
+	}
+}
+
+func (b *inotifyBackend) handleEvent(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		b.events <- watcherEvent{overflow: true}
+		return
+	}
+	b.Lock()
+	dir, ok := b.paths[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		// watch removed by kernel (directory deleted) or by removeTree
+		if ok && b.watches[dir] == wd {
+			delete(b.watches, dir)
+		}
+		delete(b.paths, wd)
+	}
+	b.Unlock()
+	if !ok || name == "" {
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	if mask&syscall.IN_ISDIR != 0 {
+		if mask&syscall.IN_MOVED_FROM != 0 {
+			b.removeTree(path)
+		}
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			b.addTree(path)
+		}
+	}
+	b.events <- watcherEvent{path: path}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package localfs
+
+func startWatcherBackend(root string, events chan<- watcherEvent) error {
+	return WatcherNotSupportedError
+}
@@ -0,0 +1,165 @@
+package localfs
+
+/*
+* Write operations on the local tree.
+*
+* Every operation announces its changes at once (see RefreshPaths), so the DFS tree and
+* the peers learn about them without waiting for the watcher or the next rescan.
+* Operations return the announced changes.
+ */
+
+import (
+	"dftp/dfsfat"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Prefix of temporary files receiving uploads; such files are never announced
+	UploadTempPrefix = ".dftp-upload-"
+)
+
+var (
+	OutsideMountPointError = fmt.Errorf("path is outside of the local tree")
+	LocalRootError         = fmt.Errorf("cannot modify the root of the local tree")
+)
+
+func isUploadTemp(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), UploadTempPrefix)
+}
+
+// Returns true if the path belongs to the local tree (local root itself excluded)
+func (fs *LocalFs) CanStore(dfsPath string) bool {
+	_, err := fs.localPath(dfsPath)
+	return err == nil
+}
+
+// Converts a path inside DFS into local filename
+func (fs *LocalFs) localPath(dfsPath string) (string, error) {
+	dfsPath = strings.Trim(filepath.Clean("/"+dfsPath), "/")
+	if fs.DfsMountPoint != "" {
+		if dfsPath == fs.DfsMountPoint {
+			return "", LocalRootError
+		}
+		if !strings.HasPrefix(dfsPath, fs.DfsMountPoint+"/") {
+			return "", OutsideMountPointError
+		}
+		dfsPath = strings.TrimPrefix(dfsPath, fs.DfsMountPoint+"/")
+	}
+	if dfsPath == "" {
+		return "", LocalRootError
+	}
+	return filepath.Join(fs.LocalRoot, dfsPath), nil
+}
+
+// Local filenames of the directories between the local root and `path`, and `path` itself
+func (fs *LocalFs) pathsUpTo(path string) []string {
+	paths := []string{path}
+	for dir := filepath.Dir(path); strings.HasPrefix(dir+"/", fs.LocalRoot) && dir+"/" != fs.LocalRoot; dir = filepath.Dir(dir) {
+		paths = append(paths, dir)
+	}
+	return paths
+}
+
+// Writes `data` into the file, creating missing parent directories.
+// Unless appending, the file is replaced only after all the data has been received.
+func (fs *LocalFs) WriteFile(dfsPath string, data io.Reader, appendData bool) (int64, []*dfsfat.FileAnnouncement, error) {
+	path, err := fs.localPath(dfsPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, nil, err
+	}
+
+	var n int64
+	if appendData {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, nil, err
+		}
+		n, err = io.Copy(f, data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return n, fs.RefreshPaths(fs.pathsUpTo(path)), err
+		}
+	} else {
+		f, err := ioutil.TempFile(filepath.Dir(path), UploadTempPrefix)
+		if err != nil {
+			return 0, nil, err
+		}
+		n, err = io.Copy(f, data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Chmod(f.Name(), 0644)
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return n, fs.RefreshPaths(fs.pathsUpTo(filepath.Dir(path))), err
+		}
+	}
+	return n, fs.RefreshPaths(fs.pathsUpTo(path)), nil
+}
+
+// Creates a directory; its parent must exist
+func (fs *LocalFs) MakeDir(dfsPath string) ([]*dfsfat.FileAnnouncement, error) {
+	path, err := fs.localPath(dfsPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+	return fs.RefreshPaths(fs.pathsUpTo(path)), nil
+}
+
+// Removes a file or an empty directory (or, if `recursive`, a directory with everything inside)
+func (fs *LocalFs) Remove(dfsPath string, recursive bool) ([]*dfsfat.FileAnnouncement, error) {
+	path, err := fs.localPath(dfsPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return nil, err
+	}
+	if recursive {
+		err = os.RemoveAll(path)
+	} else {
+		err = os.Remove(path)
+	}
+	// something may have been removed even if there was an error
+	return fs.RefreshPaths(fs.pathsUpTo(path)), err
+}
+
+// Renames a file or a directory within the local tree, creating missing parent directories
+func (fs *LocalFs) Rename(dfsFrom string, dfsTo string) ([]*dfsfat.FileAnnouncement, error) {
+	from, err := fs.localPath(dfsFrom)
+	if err != nil {
+		return nil, err
+	}
+	to, err := fs.localPath(dfsTo)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(from); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return nil, err
+	}
+	return fs.RefreshPaths(append(fs.pathsUpTo(from), fs.pathsUpTo(to)...)), nil
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"dftp/auth"
 	"dftp/cluster"
 	"dftp/dfsfat"
+	"dftp/filecache"
 	"dftp/ftpface"
 	"dftp/httpface"
 	"dftp/localfs"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,9 +23,41 @@ var (
 	optMyNodeName    = flag.String("node-name", "", "node name to use instead of hostname")
 	optHttpAddr      = flag.String("http-listen", ":7040", "host:port for public HTTP interface to listen on")
 	optFtpAddr       = flag.String("ftp-listen", ":2121", "host:port for public FTP interface to listen on")
-	optMulticastAddr = flag.String("multicast-discovery-addr", "224.0.0.9:7041", "host:port for multicast peer discovery address")
+	optUsers         = flag.String("users", "", "htpasswd-style file with HTTP and FTP users and their bcrypt password hashes (reloaded on change or SIGHUP)")
+	optFtpAnonymous  = flag.Bool("ftp-anonymous", false, "allow anonymous read-only FTP login")
+	optFtpTlsCert    = flag.String("ftp-tls-cert", "", "PEM certificate file for FTPS (empty to disable)")
+	optFtpTlsKey     = flag.String("ftp-tls-key", "", "PEM private key file for FTPS")
+	optFtpTlsMode    = flag.String("ftp-tls-mode", "explicit", "FTPS mode: explicit (AUTH TLS on --ftp-listen port) or implicit (TLS from the start)")
+	optFtpRequireTls = flag.Bool("ftp-require-tls", false, "refuse FTP logins and transfers over unencrypted connections")
+	optHttpAnonymous = flag.Bool("http-anonymous", true, "allow HTTP requests without credentials")
+	optHttpTlsCert   = flag.String("http-tls-cert", "", "PEM certificate file for HTTPS on the public interface (empty to disable)")
+	optHttpTlsKey    = flag.String("http-tls-key", "", "PEM private key file for HTTPS on the public interface")
+	optClusterCA     = flag.String("cluster-ca", "", "PEM file with the cluster CA certificate; enables mutual TLS between nodes (requires --cluster-cert, --cluster-key and HTTPS)")
+	optClusterCert   = flag.String("cluster-cert", "", "PEM certificate file of this node, issued by the cluster CA")
+	optClusterKey    = flag.String("cluster-key", "", "PEM private key file of this node")
+	optClusterSecret = flag.String("cluster-secret", "", "file with a secret shared by every node of the cluster, to sign management requests, forwarded requests and discovery pings with (empty to disable)")
+	optHttpTokens    = flag.String("http-tokens", "", "file with login:token lines of static HTTP API tokens (reloaded on change or SIGHUP)")
+	optSigningKey    = flag.String("url-signing-key", "", "file with the secret key for signed download links, the same on every node (requires --cluster-ca; empty to disable)")
+	optAcl           = flag.String("acl", "", "file with per-path access rules for HTTP and FTP users (reloaded on change or SIGHUP; empty to allow everything)")
+	optMulticastAddr = flag.String("multicast-discovery-addr", "224.0.0.9:7041", "host:port for multicast peer discovery address (empty to disable)")
+	optMulticastIf   = flag.String("multicast-interface", "", "network interface to send and receive multicast discovery pings on (empty for the system default)")
+	optMulticastTtl  = flag.Int("multicast-ttl", 1, "time-to-live of multicast discovery pings (1 keeps them within the local network)")
+	optMulticastPing = flag.Duration("multicast-ping-period", cluster.DiscoveryPingPeriod, "period of multicast discovery pings")
+	optPeers         = flag.String("peers", "", "comma-separated management addresses (host:port, or host for the same port as ours) of peers to greet at startup and whenever they are unknown")
+	optPeersDns      = flag.String("peers-dns", "", "comma-separated DNS names of peers: SRV records (_service._tcp.domain) or host names (with optional :port), re-resolved every --peers-lookup-period")
+	optPeersFile     = flag.String("peers-file", "", "file with management addresses of peers, one per line, re-read every --peers-lookup-period")
+	optPeersLookup   = flag.Duration("peers-lookup-period", cluster.PeerLookupPeriod, "period of looking up --peers-dns and --peers-file")
+	optAntiEntropy   = flag.Duration("anti-entropy-period", cluster.AntiEntropyPeriod, "period of comparing the DFS tree with a random peer to repair missed updates (0 to disable)")
 	optClusterName   = flag.String("cluster-name", "dftp", "cluster name (change it to allow multiple separate clusters work with same multicast discovery address)")
 	optHttpMgmtAddr  = flag.String("http-mgmt-listen", ":7041", "host:port for private cluster management HTTP interface to listen on")
+	optRescanPeriod  = flag.Duration("rescan-period", 10*time.Minute, "period of local directory tree rescans (0 to disable)")
+	optWatch         = flag.Bool("watch", true, "monitor local directory tree for changes (inotify, Linux only)")
+	optSnapshot      = flag.String("snapshot", "", "file to save DFS tree snapshots to and to load it from at startup (empty to disable)")
+	optSnapshotEvery = flag.Duration("snapshot-period", 5*time.Minute, "period of DFS tree snapshots")
+	optCacheDir      = flag.String("cache-dir", "", "directory to cache files read from other nodes in (empty to disable)")
+	optCacheSize     = flag.Int64("cache-size-mb", 1024, "maximum total size of cached files, in megabytes")
+	optPlacement     = flag.String("placement-policy", "parent", "which node stores new files: parent (owner of the closest existing directory), free-space (most free space), round-robin, or hash (of the path)")
+	optConflicts     = flag.String("conflict-policy", "newest", "which replica wins when nodes have different files at the same path: newest (by mtime), largest, or both (expose others as <name>@<node>)")
 )
 
 func main() {
@@ -38,30 +75,229 @@ func main() {
 		log.Fatalf("FATAL: specify --dfsroot")
 	}
 
+	conflictPolicy, err := dfsfat.ConflictPolicyByName(*optConflicts)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err)
+	}
+	dfsfat.SetConflictPolicy(conflictPolicy)
+
+	placementPolicy, err := cluster.PlacementPolicyByName(*optPlacement)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err)
+	}
+
+	multicastOpts := cluster.MulticastOptions{
+		Addr:       *optMulticastAddr,
+		Interface:  *optMulticastIf,
+		TTL:        *optMulticastTtl,
+		PingPeriod: *optMulticastPing,
+	}
+
+	peerSources := []cluster.PeerSource{}
+	if addrs := splitList(*optPeers); len(addrs) > 0 {
+		peerSources = append(peerSources, &cluster.StaticPeers{Addrs: addrs})
+	}
+	for _, name := range splitList(*optPeersDns) {
+		peerSources = append(peerSources, &cluster.DnsPeers{Name: name})
+	}
+	if *optPeersFile != "" {
+		peerSources = append(peerSources, &cluster.PeersFile{Path: *optPeersFile})
+	}
+
 	dfs := dfsfat.NewRootNode()
 	localfs := localfs.NewLocalFs(*optDfsRoot, *optDfsMountPoint, dfs, myNodeName)
-	localfs.ScanOnce()
+	cluster := cluster.New(dfs, localfs, *optClusterName, *optHttpAddr, *optHttpMgmtAddr)
+	cluster.Placement = placementPolicy
+
+	if (*optHttpTlsCert == "") != (*optHttpTlsKey == "") {
+		log.Fatalf("FATAL: both --http-tls-cert and --http-tls-key are required for HTTPS")
+	}
+	cluster.PublicTLS = *optHttpTlsCert != ""
+	if *optClusterCA != "" || *optClusterCert != "" || *optClusterKey != "" {
+		if *optClusterCA == "" || *optClusterCert == "" || *optClusterKey == "" {
+			log.Fatalf("FATAL: --cluster-ca, --cluster-cert and --cluster-key are required for mutual TLS")
+		}
+		if *optHttpAddr != "" && !cluster.PublicTLS {
+			// peers forward requests to the public interface, and must be recognized there
+			log.Fatalf("FATAL: mutual TLS requires HTTPS on the public interface (--http-tls-cert, --http-tls-key)")
+		}
+		if err := cluster.EnableMutualTLS(*optClusterCA, *optClusterCert, *optClusterKey); err != nil {
+			log.Fatalf("FATAL: cannot enable mutual TLS: %s", err)
+		}
+	}
+
+	if *optClusterSecret != "" {
+		if err := cluster.EnableSigning(*optClusterSecret); err != nil {
+			log.Fatalf("FATAL: cannot load cluster secret: %s", err)
+		}
+	}
+
+	if *optSigningKey != "" {
+		if *optClusterCA == "" {
+			// anyone reaching the management interface could make links on behalf of any user
+			log.Fatalf("FATAL: --url-signing-key requires mutual TLS (--cluster-ca), so that only administrators can make signed links")
+		}
+		cluster.UrlSigner, err = auth.NewUrlSigner(*optSigningKey)
+		if err != nil {
+			log.Fatalf("FATAL: cannot load URL signing key: %s", err)
+		}
+	}
+
+	if *optCacheDir != "" {
+		cache, err := filecache.New(*optCacheDir, *optCacheSize*1024*1024)
+		if err != nil {
+			log.Fatalf("FATAL: cannot open cache: %s", err)
+		}
+		cluster.Proxy.Cache = cache
+	}
+
+	warmStart := false
+	if *optSnapshot != "" {
+		err := cluster.LoadSnapshot(*optSnapshot)
+		if err == nil {
+			warmStart = true
+		} else if !os.IsNotExist(err) {
+			log.Printf("WARN: cannot load snapshot, starting from scratch: %s", err)
+		}
+	}
 
-	cluster := cluster.New(dfs, localfs, *optClusterName, *optHttpAddr, *optHttpMgmtAddr, *optMulticastAddr)
+	scan := func() {
+		// changes made while scanning are refreshed by the watcher once the scan is over
+		if *optWatch {
+			if err := localfs.StartWatcher(); err != nil {
+				log.Printf("WARN: cannot monitor local changes, relying on periodic rescans: %s", err)
+			}
+		}
+		localfs.ScanOnce()
+		localfs.StartPeriodicRescan(*optRescanPeriod)
+	}
+	if warmStart {
+		// serve the tree from the snapshot while scanning
+		go scan()
+	} else {
+		scan()
+	}
+
+	cluster.Start()
+	if *optAntiEntropy > 0 {
+		cluster.StartAntiEntropy(*optAntiEntropy)
+	}
+	if *optMulticastAddr != "" {
+		err := cluster.StartMulticastDiscovery(multicastOpts)
+		if err != nil {
+			log.Fatalf("FATAL: cannot start multicast discovery: %s", err)
+		}
+	}
+	if len(peerSources) > 0 {
+		cluster.StartPeerDiscovery(peerSources, *optPeersLookup)
+	}
 	go cluster.ServeHttp(*optHttpMgmtAddr)
+	if *optSnapshot != "" {
+		cluster.StartPeriodicSnapshots(*optSnapshot, *optSnapshotEvery)
+	}
+
+	var acl *auth.Acl
+	if *optAcl != "" {
+		acl, err = auth.NewAcl(*optAcl)
+		if err != nil {
+			log.Fatalf("FATAL: cannot load access rules: %s", err)
+		}
+	}
 
+	var users *auth.UserDb
+	if *optUsers != "" || *optFtpAddr != "" {
+		users, err = auth.NewUserDb(*optUsers, *optFtpAnonymous)
+		if err != nil {
+			log.Fatalf("FATAL: cannot load users: %s", err)
+		}
+	}
+
+	var tokens *auth.TokenDb
 	if *optHttpAddr != "" {
 		server := httpface.Server{
-			DfsRoot: dfs,
-			Cluster: cluster,
+			DfsRoot:   dfs,
+			Cluster:   cluster,
+			Acl:       acl,
+			Anonymous: *optHttpAnonymous,
+
+			TLSCertFile: *optHttpTlsCert,
+			TLSKeyFile:  *optHttpTlsKey,
+		}
+		if *optUsers != "" {
+			server.Authenticators = append(server.Authenticators, &httpface.BasicAuthenticator{Users: users})
+		}
+		if *optHttpTokens != "" {
+			tokens, err = auth.NewTokenDb(*optHttpTokens)
+			if err != nil {
+				log.Fatalf("FATAL: cannot load HTTP API tokens: %s", err)
+			}
+			server.Authenticators = append(server.Authenticators, &httpface.TokenAuthenticator{Tokens: tokens})
+		}
+		if cluster.UrlSigner != nil {
+			server.Authenticators = append(server.Authenticators, &httpface.SignedUrlAuthenticator{Signer: cluster.UrlSigner})
 		}
 		go server.ServeHttp(*optHttpAddr)
 	}
 
 	if *optFtpAddr != "" {
+		if (*optFtpTlsCert == "") != (*optFtpTlsKey == "") {
+			log.Fatalf("FATAL: both --ftp-tls-cert and --ftp-tls-key are required for FTPS")
+		}
+		if *optFtpRequireTls && *optFtpTlsCert == "" {
+			log.Fatalf("FATAL: --ftp-require-tls requires --ftp-tls-cert and --ftp-tls-key")
+		}
+		if *optFtpTlsMode != "explicit" && *optFtpTlsMode != "implicit" {
+			log.Fatalf("FATAL: unknown FTPS mode `%s` (use explicit or implicit)", *optFtpTlsMode)
+		}
 		server := ftpface.Server{
-			DfsRoot: dfs,
-			Cluster: cluster,
+			DfsRoot:     dfs,
+			Cluster:     cluster,
+			Users:       users,
+			Acl:         acl,
+			TLSCertFile: *optFtpTlsCert,
+			TLSKeyFile:  *optFtpTlsKey,
+			ImplicitTLS: *optFtpTlsMode == "implicit",
+			RequireTLS:  *optFtpRequireTls,
 		}
 		go server.ServeFtp(*optFtpAddr)
 	}
 
-	for {
-		time.Sleep(1 * time.Second)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		if users != nil {
+			if err := users.Reload(); err != nil {
+				log.Printf("ERROR: cannot reload users: %s", err)
+			}
+		}
+		if tokens != nil {
+			if err := tokens.Reload(); err != nil {
+				log.Printf("ERROR: cannot reload HTTP API tokens: %s", err)
+			}
+		}
+		if acl != nil {
+			if err := acl.Reload(); err != nil {
+				log.Printf("ERROR: cannot reload access rules: %s", err)
+			}
+		}
+		sig = <-signals
+	}
+	log.Printf("Received %s, shutting down", sig)
+	if *optSnapshot != "" {
+		if err := cluster.SaveSnapshot(*optSnapshot); err != nil {
+			log.Printf("ERROR: cannot save snapshot: %s", err)
+		}
+	}
+}
+
+// Splits a comma-separated flag value, skipping empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }